@@ -5,133 +5,537 @@ import (
 	"github.com/ghodss/yaml"
 	"github.com/imroc/helm-cos/pkg/cos"
 	"github.com/pkg/errors"
-	"io/ioutil"
+	"golang.org/x/crypto/ssh/terminal"
+	"k8s.io/client-go/util/homedir"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
-	"golang.org/x/crypto/ssh/terminal"
+	"time"
 )
 
+// EnvConfigFile is the environment variable overriding the path of the configuration file.
+const EnvConfigFile = "HELM_COS_CONFIG"
+
 type CosConfig struct {
-	SecretId  string `json:"secret_id"`
-	SecretKey string `json:"secret_key"`
+	SecretId     string `json:"secret_id"`
+	SecretKey    string `json:"secret_key"`
+	SessionToken string `json:"session_token,omitempty"`
+	// Expiration is the time temporary credentials expire at.
+	Expiration *time.Time `json:"expiration,omitempty"`
+
+	// Source describes where the credentials come from.
+	Source string `json:"-"`
 }
 
-type Config map[string]*CosConfig
+// Config is the content of helm-cos.yaml.
+type Config struct {
+	// Profiles are the stored credentials, by name.
+	Profiles map[string]*CosConfig `json:"profiles"`
+	// Bindings associate buckets, or bucket/path prefixes, to profile names.
+	Bindings map[string]string `json:"bindings"`
+	// Buckets are the connection settings of buckets, by the host of their url.
+	Buckets map[string]*BucketConfig `json:"buckets,omitempty"`
+	// Retry tunes the retries of failed requests.
+	Retry *RetryConfig `json:"retry,omitempty"`
+}
 
-var config Config
+// RetryConfig tunes the retries of failed requests, see cos.RetryPolicy.
+// Durations are strings like "500ms" or "1m"; empty fields keep the defaults.
+type RetryConfig struct {
+	MaxAttempts int    `json:"max_attempts,omitempty"`
+	BaseDelay   string `json:"base_delay,omitempty"`
+	MaxDelay    string `json:"max_delay,omitempty"`
+	MaxElapsed  string `json:"max_elapsed,omitempty"`
+}
 
-func getConfigFilename() string {
-	basedir := os.Getenv("HELM_PLUGIN_DIR")
-	if basedir == "" {
-		panic("need env HELM_PLUGIN_DIR")
+// apply overrides the fields of p set in r.
+func (r *RetryConfig) apply(p *cos.RetryPolicy) error {
+	if r.MaxAttempts < 0 {
+		return fmt.Errorf("retry max_attempts: invalid number of attempts %d", r.MaxAttempts)
+	}
+	if r.MaxAttempts > 0 {
+		p.MaxAttempts = r.MaxAttempts
+	}
+	for _, d := range []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"base_delay", r.BaseDelay, &p.BaseDelay},
+		{"max_delay", r.MaxDelay, &p.MaxDelay},
+		{"max_elapsed", r.MaxElapsed, &p.MaxElapsed},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return errors.Wrapf(err, "retry %s", d.name)
+		}
+		*d.field = v
 	}
-	filename := basedir + string(os.PathSeparator) + "helm-cos.yaml"
-	return filename
+	return nil
 }
 
-func getConfig() (Config, error) {
-	if config != nil {
-		return config, nil
+// BucketConfig holds the connection settings of a bucket.
+type BucketConfig struct {
+	// Region of the bucket, e.g. "ap-guangzhou". If set, the host of the
+	// bucket url can be the bare bucket name.
+	Region string `json:"region,omitempty"`
+	// AppId is appended to the bucket name if it doesn't end with it.
+	AppId string `json:"appid,omitempty"`
+	// Scheme is "https", the default, or "http".
+	Scheme string `json:"scheme,omitempty"`
+	// Endpoint is the host to send requests to, instead of the one derived
+	// from the bucket and region.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// CAFile is a PEM bundle of certificate authorities trusted in addition to the system ones.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// MinTLSVersion is the minimum TLS version, e.g. "1.2".
+	MinTLSVersion string `json:"min_tls_version,omitempty"`
+}
+
+// Validate checks the settings.
+func (b *BucketConfig) Validate() error {
+	if b.Scheme != "" && b.Scheme != "http" && b.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q, must be http or https", b.Scheme)
+	}
+	if (b.CertFile == "") != (b.KeyFile == "") {
+		return errors.New("the client certificate and key files must be given together")
+	}
+	if _, ok := tlsVersions[b.MinTLSVersion]; b.MinTLSVersion != "" && !ok {
+		return fmt.Errorf("invalid minimum TLS version %q, must be 1.0, 1.1, 1.2 or 1.3", b.MinTLSVersion)
+	}
+	return nil
+}
+
+// host returns the host of the bucket, named as in its url.
+func (b *BucketConfig) host(bucket string) string {
+	if b.Endpoint != "" {
+		return b.Endpoint
+	}
+	if b.Region == "" || strings.Contains(bucket, ".") {
+		return bucket
+	}
+	if b.AppId != "" && !strings.HasSuffix(bucket, "-"+b.AppId) {
+		bucket += "-" + b.AppId
+	}
+	return fmt.Sprintf("%s.cos.%s.myqcloud.com", bucket, b.Region)
+}
+
+// Retry overrides the retry settings of the configuration file, e.g. with flags.
+var Retry RetryConfig
+
+const (
+	// EnvMaxAttempts and EnvRetryMaxElapsed override the retry settings of
+	// the configuration file, unless they are set in Retry.
+	EnvMaxAttempts     = "HELM_COS_MAX_ATTEMPTS"
+	EnvRetryMaxElapsed = "HELM_COS_RETRY_MAX_ELAPSED"
+)
+
+// PlainHTTP sends requests over HTTP instead of HTTPS, for every bucket.
+var PlainHTTP bool
+
+// NonInteractive disables prompting for credentials when none are found.
+var NonInteractive bool
+
+// InsecurePlaintext allows storing credentials in a configuration file that
+// is not encrypted with EnvPassphrase or EnvKeyFile.
+var InsecurePlaintext bool
+
+// ErrPlaintext occurs when storing credentials in a configuration file that
+// would not be encrypted, unless InsecurePlaintext is set.
+var ErrPlaintext = fmt.Errorf("refusing to store credentials in plaintext: set %s or %s to encrypt them, or use --insecure-plaintext", EnvPassphrase, EnvKeyFile)
+
+// Profile is the name of the profile to use instead of the one bound to the bucket.
+var Profile string
+
+var config *Config
+
+func newConfig() *Config {
+	return &Config{
+		Profiles: make(map[string]*CosConfig),
+		Bindings: make(map[string]string),
+		Buckets:  make(map[string]*BucketConfig),
 	}
-	config = make(Config)
-	filename := getConfigFilename()
-	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0666)
+}
+
+// parseConfig parses a configuration file.
+// Files from older versions, which map each bucket to its credentials, are
+// converted to one profile per bucket.
+func parseConfig(b []byte) (*Config, error) {
+	keys := make(map[string]interface{})
+	err := yaml.Unmarshal(b, &keys)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	b, err := ioutil.ReadAll(file)
+	c := newConfig()
+	_, hasProfiles := keys["profiles"]
+	_, hasBindings := keys["bindings"]
+	_, hasBuckets := keys["buckets"]
+	_, hasRetry := keys["retry"]
+	if hasProfiles || hasBindings || hasBuckets || hasRetry {
+		err = yaml.Unmarshal(b, c)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if c.Profiles == nil {
+			c.Profiles = make(map[string]*CosConfig)
+		}
+		if c.Bindings == nil {
+			c.Bindings = make(map[string]string)
+		}
+		if c.Buckets == nil {
+			c.Buckets = make(map[string]*BucketConfig)
+		}
+		return c, nil
+	}
+	legacy := make(map[string]*CosConfig)
+	err = yaml.Unmarshal(b, &legacy)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	err = yaml.Unmarshal(b, &config)
+	for bucket, cosConfig := range legacy {
+		c.Profiles[bucket] = cosConfig
+		c.Bindings[bucket] = bucket
+	}
+	return c, nil
+}
+
+// Location returns the key used to look up the profile of a bucket and path,
+// e.g. "bucket-appid.cos.ap-guangzhou.myqcloud.com/charts".
+func Location(bucket, p string) string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return bucket
+	}
+	return bucket + "/" + p
+}
+
+// splitLocation returns the bucket host of a location.
+func splitLocation(location string) string {
+	return strings.SplitN(location, "/", 2)[0]
+}
+
+// bindingFor returns the profile bound to the longest prefix of location.
+func (c *Config) bindingFor(location string) (string, bool) {
+	best, name := "", ""
+	for prefix, profile := range c.Bindings {
+		if location != prefix && !strings.HasPrefix(location, prefix+"/") {
+			continue
+		}
+		if len(prefix) > len(best) {
+			best, name = prefix, profile
+		}
+	}
+	return name, best != ""
+}
+
+// getConfigFilename returns the path of the configuration file: the one given
+// by EnvConfigFile, or the one of older versions in the plugin directory if
+// it exists, otherwise config.yaml in $XDG_CONFIG_HOME/helm-cos.
+func getConfigFilename() string {
+	if filename := os.Getenv(EnvConfigFile); filename != "" {
+		return filename
+	}
+	if basedir := os.Getenv("HELM_PLUGIN_DIR"); basedir != "" {
+		filename := filepath.Join(basedir, "helm-cos.yaml")
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(homedir.HomeDir(), ".config")
+	}
+	return filepath.Join(dir, "helm-cos", "config.yaml")
+}
+
+func getConfig() (*Config, error) {
+	if config != nil {
+		return config, nil
+	}
+	c, err := readConfigFile(getConfigFilename())
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
+	config = c
 	return config, nil
 }
 
-func InputCosConfig(bucket string) *CosConfig {
+// InputCosConfig prompts for the credentials of a location and stores them.
+// It fails in non-interactive mode or if stdin is not a terminal.
+func InputCosConfig(location string) (*CosConfig, error) {
+	cosConfig, err := PromptCosConfig(location)
+	if err != nil || cosConfig == nil {
+		return nil, err
+	}
+	err = UpdateBucketConfig(location, cosConfig)
+	if err == ErrPlaintext {
+		// the credentials are still used by the running command
+		println("Credentials not saved:", err.Error())
+		return cosConfig, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cosConfig, nil
+}
+
+// PromptCosConfig prompts for the credentials of a location.
+// It returns nil if they are empty, and fails in non-interactive mode or if
+// stdin is not a terminal.
+func PromptCosConfig(location string) (*CosConfig, error) {
+	if NonInteractive || !terminal.IsTerminal(int(syscall.Stdin)) {
+		return nil, fmt.Errorf("no credentials found for %s: run \"helm cos login\" or set %s and %s", location, EnvSecretId, EnvSecretKey)
+	}
 	println("Please login at first, enter your SecretId and SecretKey")
 	var secretId, secretKey string
 	print("SecretId:")
 	fmt.Scanln(&secretId)
 	print("SecretKey:")
 	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+	println()
 	if err != nil {
-		panic(err)
+		return nil, errors.WithStack(err)
 	}
 	secretKey = string(bytePassword)
 
 	if secretId == "" || secretKey == "" {
 		println("Empty SecretId or SecretKey, please retry")
-		return nil
+		return nil, nil
 	}
-
-	cosConfig := &CosConfig{
+	return &CosConfig{
 		SecretId:  secretId,
 		SecretKey: secretKey,
-	}
-	err = UpdateBucketConfig(bucket, cosConfig)
-	if err != nil {
-		panic(err)
-	}
-	return cosConfig
+		Source:    "prompt",
+	}, nil
 }
 
-func ReadBucketConfig(bucket string) (*CosConfig, error) {
+// ReadBucketConfig returns the stored credentials of a location: the ones of
+// Profile if set, otherwise the ones of the profile bound to the location.
+// It returns nil if there are none.
+func ReadBucketConfig(location string) (*CosConfig, error) {
 	c, err := getConfig()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	cosConfig, ok := c[bucket]
+	name := Profile
+	if name == "" {
+		var ok bool
+		name, ok = c.bindingFor(location)
+		if !ok {
+			return nil, nil
+		}
+	}
+	cosConfig, ok := c.Profiles[name]
 	if !ok {
+		if Profile != "" {
+			return nil, fmt.Errorf("profile \"%s\" not found", Profile)
+		}
 		return nil, nil
 	}
+	cosConfig.Source = fmt.Sprintf("profile \"%s\"", name)
 	return cosConfig, nil
 }
 
-func GetBucketConfig(bucket string) (*CosConfig, error) {
-	c, err := ReadBucketConfig(bucket)
+// GetBucketConfig returns the credentials of a location from the providers of
+// Credentials, see DefaultCredentials for the default order.
+// If none is found, the credentials are prompted.
+func GetBucketConfig(location string) (*CosConfig, error) {
+	if Credentials == nil {
+		Credentials = DefaultCredentials()
+	}
+	c, err := Credentials.Retrieve(location)
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 	if c != nil {
 		return c, nil
 	}
-	c = InputCosConfig(bucket)
-	return c, nil
+	return InputCosConfig(location)
 }
 
-func UpdateBucketConfig(bucket string, cosConfig *CosConfig) error {
+// UpdateBucketConfig stores the credentials of a location in Profile, or in a
+// profile named after the location if not set, and binds the profile to it.
+// It fails with ErrPlaintext if they would not be encrypted.
+func UpdateBucketConfig(location string, cosConfig *CosConfig) error {
+	if cosConfig.SecretKey != "" && !InsecurePlaintext {
+		secret, _, err := storeKey()
+		if err != nil {
+			return err
+		}
+		if secret == nil {
+			return ErrPlaintext
+		}
+	}
 	c, err := getConfig()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	c[bucket] = cosConfig
-	b, err := yaml.Marshal(c)
+	name := Profile
+	if name == "" {
+		name = location
+	}
+	c.Profiles[name] = cosConfig
+	c.Bindings[location] = name
+	return writeConfigFile(getConfigFilename(), c)
+}
+
+// DeleteBucketConfig removes the binding of a location, and its profile if it
+// is not bound to any other location.
+func DeleteBucketConfig(location string) error {
+	c, err := getConfig()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	filename := getConfigFilename()
-	err = ioutil.WriteFile(filename, b, 0644)
+	name, ok := c.Bindings[location]
+	if !ok {
+		return fmt.Errorf("no credentials stored for %s", location)
+	}
+	delete(c.Bindings, location)
+	for _, profile := range c.Bindings {
+		if profile == name {
+			return writeConfigFile(getConfigFilename(), c)
+		}
+	}
+	delete(c.Profiles, name)
+	return writeConfigFile(getConfigFilename(), c)
+}
+
+// DeleteProfile removes a profile and all its bindings.
+func DeleteProfile(name string) error {
+	c, err := getConfig()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return nil
+	if _, ok := c.Profiles[name]; !ok {
+		return fmt.Errorf("profile \"%s\" not found", name)
+	}
+	delete(c.Profiles, name)
+	for location, profile := range c.Bindings {
+		if profile == name {
+			delete(c.Bindings, location)
+		}
+	}
+	return writeConfigFile(getConfigFilename(), c)
+}
+
+// GetBucketSettings returns the connection settings of a bucket, named as in
+// its url. They are empty if none are stored.
+func GetBucketSettings(bucket string) (*BucketConfig, error) {
+	c, err := getConfig()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if b, ok := c.Buckets[bucket]; ok {
+		return b, nil
+	}
+	return &BucketConfig{}, nil
 }
 
-func GetCosClient(endpoint string) (*cos.Client, error) {
-	cosConfig, err := GetBucketConfig(endpoint)
+// UpdateBucketSettings stores the connection settings of a bucket, named as in its url.
+func UpdateBucketSettings(bucket string, settings *BucketConfig) error {
+	err := settings.Validate()
+	if err != nil {
+		return err
+	}
+	c, err := getConfig()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if *settings == (BucketConfig{}) {
+		delete(c.Buckets, bucket)
+	} else {
+		c.Buckets[bucket] = settings
+	}
+	return writeConfigFile(getConfigFilename(), c)
+}
+
+// GetCosClient returns a client for a location, see Location.
+// The bucket host of the location is used, with the stored settings of the
+// bucket, to build the endpoint and the path to select the credentials.
+func GetCosClient(location string) (*cos.Client, error) {
+	cosConfig, err := GetBucketConfig(location)
 	if err != nil {
 		return nil, err
 	}
 	if cosConfig == nil {
 		return nil, errors.New("Empty SecretId or SecretKey")
 	}
+	settings, err := GetBucketSettings(splitLocation(location))
+	if err != nil {
+		return nil, err
+	}
+	return NewCosClient(location, cosConfig, settings)
+}
+
+// NewCosClient returns a client for a location using the given credentials and bucket settings.
+// Requests are sent over HTTPS unless PlainHTTP is set or the scheme of the bucket is "http".
+func NewCosClient(location string, cosConfig *CosConfig, settings *BucketConfig) (*cos.Client, error) {
+	endpoint := settings.host(splitLocation(location))
+	tlsConfig, err := settings.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
 	client := &cos.Client{
+		AppId:           settings.AppId,
+		Region:          cos.Region(settings.Region),
+		Secure:          !PlainHTTP && settings.Scheme != "http",
+		TLSClientConfig: tlsConfig,
 		AccessKeyId:     cosConfig.SecretId,
 		AccessKeySecret: cosConfig.SecretKey,
+		SessionToken:    cosConfig.SessionToken,
+	}
+	if cosConfig.Expiration != nil {
+		client.Expiration = *cosConfig.Expiration
+		if client.Expired() {
+			return nil, errors.Wrapf(cos.ErrCredentialsExpired, "credentials of %s", endpoint)
+		}
+	}
+	client.RetryPolicy, err = retryPolicy()
+	if err != nil {
+		return nil, err
 	}
 	client.SetEndpoint(endpoint)
 	return client, nil
 }
+
+// retryPolicy returns the retry policy of the configuration file, overridden
+// by Retry or, where it is not set, by EnvMaxAttempts and EnvRetryMaxElapsed.
+func retryPolicy() (*cos.RetryPolicy, error) {
+	p := cos.DefaultRetryPolicy
+	c, err := getConfig()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if c.Retry != nil {
+		err = c.Retry.apply(&p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	retry := Retry
+	if v := os.Getenv(EnvMaxAttempts); v != "" && retry.MaxAttempts == 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%s: invalid number of attempts %q", EnvMaxAttempts, v)
+		}
+		retry.MaxAttempts = n
+	}
+	if retry.MaxElapsed == "" {
+		retry.MaxElapsed = os.Getenv(EnvRetryMaxElapsed)
+	}
+	err = retry.apply(&p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
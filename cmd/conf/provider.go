@@ -0,0 +1,304 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// Environment variables configuring the credential providers.
+const (
+	EnvSecretId          = "COS_SECRET_ID"
+	EnvSecretKey         = "COS_SECRET_KEY"
+	EnvSessionToken      = "COS_SESSION_TOKEN"
+	EnvExpiration        = "COS_SESSION_EXPIRATION"
+	EnvCredentialsFile   = "COS_CREDENTIALS_FILE"
+	EnvCredentialProcess = "COS_CREDENTIAL_PROCESS"
+	EnvMetadataURL       = "COS_METADATA_URL"
+	EnvUseMetadata       = "COS_USE_METADATA"
+)
+
+// DefaultMetadataURL is the metadata service of Tencent Cloud CVM instances.
+const DefaultMetadataURL = "http://metadata.tencentyun.com/latest/meta-data"
+
+// CredentialProvider retrieves the credentials of a location, see Location.
+// Retrieve returns nil without error if the provider has no credentials for the location.
+type CredentialProvider interface {
+	Retrieve(location string) (*CosConfig, error)
+}
+
+// Credentials is the provider used by GetBucketConfig.
+// If nil, DefaultCredentials is used.
+var Credentials CredentialProvider
+
+var flagCredentials *CosConfig
+
+// SetFlagCredentials sets the credentials given on the command line,
+// they take precedence over any other source.
+func SetFlagCredentials(secretId, secretKey string) {
+	if secretId == "" || secretKey == "" {
+		flagCredentials = nil
+		return
+	}
+	flagCredentials = &CosConfig{
+		SecretId:  secretId,
+		SecretKey: secretKey,
+		Source:    "command line",
+	}
+}
+
+// DefaultCredentials returns the default chain of providers, looking in order at:
+//  1. the credentials given on the command line
+//  2. the COS_SECRET_ID, COS_SECRET_KEY, COS_SESSION_TOKEN and COS_SESSION_EXPIRATION environment variables
+//  3. the credentials file pointed by COS_CREDENTIALS_FILE
+//  4. the output of the command given by COS_CREDENTIAL_PROCESS
+//  5. the credentials stored in helm-cos.yaml by "helm cos login"
+//  6. the metadata service at COS_METADATA_URL, or at DefaultMetadataURL if COS_USE_METADATA is "true"
+//
+// If a profile is selected, the stored credentials come right after the ones
+// given on the command line.
+func DefaultCredentials() CredentialProvider {
+	chain := &ChainProvider{}
+	if flagCredentials != nil {
+		chain.Providers = append(chain.Providers, &StaticProvider{Config: flagCredentials})
+	}
+	if Profile != "" {
+		chain.Providers = append(chain.Providers, &ConfigProvider{})
+	}
+	chain.Providers = append(chain.Providers, &EnvProvider{})
+	if filename := os.Getenv(EnvCredentialsFile); filename != "" {
+		chain.Providers = append(chain.Providers, &FileProvider{Filename: filename})
+	}
+	if command := os.Getenv(EnvCredentialProcess); command != "" {
+		chain.Providers = append(chain.Providers, &ProcessProvider{Command: command})
+	}
+	if Profile == "" {
+		chain.Providers = append(chain.Providers, &ConfigProvider{})
+	}
+	if u := os.Getenv(EnvMetadataURL); u != "" {
+		chain.Providers = append(chain.Providers, &MetadataProvider{URL: u})
+	} else if strings.ToLower(os.Getenv(EnvUseMetadata)) == "true" {
+		chain.Providers = append(chain.Providers, &MetadataProvider{URL: DefaultMetadataURL})
+	}
+	return chain
+}
+
+// expiryWindow is how long before their expiration cached credentials are renewed.
+const expiryWindow = time.Minute
+
+// ChainProvider asks its providers in order and returns the first credentials found.
+// Credentials are cached per location until they expire.
+type ChainProvider struct {
+	Providers []CredentialProvider
+
+	mu    sync.Mutex
+	cache map[string]*CosConfig
+}
+
+func (p *ChainProvider) Retrieve(location string) (*CosConfig, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c, ok := p.cache[location]; ok {
+		if c.Expiration == nil || time.Now().Add(expiryWindow).Before(*c.Expiration) {
+			return c, nil
+		}
+		delete(p.cache, location)
+	}
+	for _, provider := range p.Providers {
+		c, err := provider.Retrieve(location)
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			if p.cache == nil {
+				p.cache = make(map[string]*CosConfig)
+			}
+			p.cache[location] = c
+			return c, nil
+		}
+	}
+	return nil, nil
+}
+
+// StaticProvider returns the same credentials for every location.
+type StaticProvider struct {
+	Config *CosConfig
+}
+
+func (p *StaticProvider) Retrieve(location string) (*CosConfig, error) {
+	return p.Config, nil
+}
+
+// EnvProvider reads the credentials from the environment variables.
+// The expiration of temporary credentials is given in RFC 3339 format.
+type EnvProvider struct{}
+
+func (p *EnvProvider) Retrieve(location string) (*CosConfig, error) {
+	secretId, secretKey := os.Getenv(EnvSecretId), os.Getenv(EnvSecretKey)
+	if secretId == "" || secretKey == "" {
+		return nil, nil
+	}
+	c := &CosConfig{
+		SecretId:     secretId,
+		SecretKey:    secretKey,
+		SessionToken: os.Getenv(EnvSessionToken),
+		Source:       "environment",
+	}
+	if expiration := os.Getenv(EnvExpiration); expiration != "" {
+		t, err := time.Parse(time.RFC3339, expiration)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s", EnvExpiration)
+		}
+		c.Expiration = &t
+	}
+	return c, nil
+}
+
+// FileProvider reads the credentials from a file which has the same format
+// as an entry of helm-cos.yaml.
+type FileProvider struct {
+	Filename string
+}
+
+func (p *FileProvider) Retrieve(location string) (*CosConfig, error) {
+	b, err := ioutil.ReadFile(p.Filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "read credentials file")
+	}
+	c := &CosConfig{}
+	err = yaml.Unmarshal(b, c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse credentials file %s", p.Filename)
+	}
+	if c.SecretId == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("credentials file %s: empty secret_id or secret_key", p.Filename)
+	}
+	c.Source = "file " + p.Filename
+	return c, nil
+}
+
+// ConfigProvider reads the credentials stored in helm-cos.yaml by "helm cos login".
+type ConfigProvider struct{}
+
+func (p *ConfigProvider) Retrieve(location string) (*CosConfig, error) {
+	return ReadBucketConfig(location)
+}
+
+// ProcessProvider runs an external command which prints the credentials on stdout,
+// as a JSON object with the same keys as an entry of helm-cos.yaml.
+// The bucket host and the location are given to the command in the COS_BUCKET
+// and COS_LOCATION environment variables.
+type ProcessProvider struct {
+	Command string
+}
+
+func (p *ProcessProvider) Retrieve(location string) (*CosConfig, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", p.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", p.Command)
+	}
+	cmd.Env = append(os.Environ(), "COS_BUCKET="+splitLocation(location), "COS_LOCATION="+location)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "credential process %q", p.Command)
+	}
+	c := &CosConfig{}
+	err = json.Unmarshal(out, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse credential process output")
+	}
+	if c.SecretId == "" || c.SecretKey == "" {
+		return nil, fmt.Errorf("credential process %q: empty secret_id or secret_key", p.Command)
+	}
+	c.Source = "credential process"
+	return c, nil
+}
+
+// MetadataProvider retrieves the temporary credentials of the CAM role bound to
+// the instance from a metadata service such as DefaultMetadataURL.
+// If Role is empty, the first role listed by the service is used.
+type MetadataProvider struct {
+	URL    string
+	Role   string
+	Client *http.Client
+}
+
+type metadataCredentials struct {
+	TmpSecretId  string
+	TmpSecretKey string
+	Token        string
+	ExpiredTime  int64
+	Code         string
+}
+
+func (p *MetadataProvider) get(path string) ([]byte, error) {
+	c := p.Client
+	if c == nil {
+		c = &http.Client{Timeout: 5 * time.Second}
+	}
+	u := strings.TrimRight(p.URL, "/") + "/cam/security-credentials/" + path
+	resp, err := c.Get(u)
+	if err != nil {
+		return nil, errors.Wrap(err, "metadata service")
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "metadata service")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata service: GET %s: %s", u, resp.Status)
+	}
+	return b, nil
+}
+
+func (p *MetadataProvider) Retrieve(location string) (*CosConfig, error) {
+	role := p.Role
+	if role == "" {
+		b, err := p.get("")
+		if err != nil {
+			return nil, err
+		}
+		role = strings.TrimSpace(string(bytes.SplitN(b, []byte("\n"), 2)[0]))
+		if role == "" {
+			return nil, nil
+		}
+	}
+	b, err := p.get(role)
+	if err != nil {
+		return nil, err
+	}
+	m := &metadataCredentials{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse metadata credentials")
+	}
+	if m.Code != "" && m.Code != "Success" {
+		return nil, fmt.Errorf("metadata service: role %s: %s", role, m.Code)
+	}
+	c := &CosConfig{
+		SecretId:     m.TmpSecretId,
+		SecretKey:    m.TmpSecretKey,
+		SessionToken: m.Token,
+		Source:       "metadata role " + role,
+	}
+	if m.ExpiredTime != 0 {
+		expiration := time.Unix(m.ExpiredTime, 0)
+		c.Expiration = &expiration
+	}
+	return c, nil
+}
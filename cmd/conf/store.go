@@ -0,0 +1,209 @@
+package conf
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/ghodss/yaml"
+	"github.com/imroc/helm-cos/pkg/cos/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Environment variables holding the key of the encrypted configuration.
+const (
+	EnvPassphrase = "HELM_COS_PASSPHRASE"
+	EnvKeyFile    = "HELM_COS_KEY_FILE"
+)
+
+// configFileMode is the only permission allowed on the configuration file.
+const configFileMode = 0600
+
+const (
+	encryptionAESGCM = "aes-256-gcm"
+	kdfScrypt        = "scrypt"
+	kdfSHA256        = "sha256"
+)
+
+// encryptedConfig is the format of an encrypted configuration file.
+// Data is the configuration sealed with AES-GCM, using a key derived from
+// the passphrase with scrypt or from the content of the key file with SHA-256.
+type encryptedConfig struct {
+	Encryption string `json:"encryption"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"`
+}
+
+// storeKey returns the secret configured to encrypt the configuration file
+// and the way to derive a key from it, or nil if encryption is not configured.
+func storeKey() ([]byte, string, error) {
+	if p := os.Getenv(EnvPassphrase); p != "" {
+		return []byte(p), kdfScrypt, nil
+	}
+	if f := os.Getenv(EnvKeyFile); f != "" {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "read key file")
+		}
+		return b, kdfSHA256, nil
+	}
+	return nil, "", nil
+}
+
+func deriveKey(secret []byte, kdf string, salt []byte) ([]byte, error) {
+	switch kdf {
+	case kdfScrypt:
+		return scrypt.Key(secret, salt, 1<<15, 8, 1, 32)
+	case kdfSHA256:
+		sum := sha256.Sum256(secret)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unknown key derivation %q", kdf)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// readConfigFile reads the configuration file, decrypting it if needed.
+// Plaintext configurations are encrypted in place when a key is configured.
+func readConfigFile(filename string) (*Config, error) {
+	c := newConfig()
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = enforceMode(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, _, err := storeKey()
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptedConfig{}
+	if yaml.Unmarshal(b, e) != nil || e.Encryption == "" {
+		c, err = parseConfig(b)
+		if err != nil {
+			return nil, err
+		}
+		if secret != nil && len(c.Profiles) > 0 {
+			// migrate the plaintext credentials
+			err = writeConfigFile(filename, c)
+			if err != nil {
+				return nil, errors.Wrap(err, "encrypt configuration")
+			}
+		}
+		return c, nil
+	}
+
+	if e.Encryption != encryptionAESGCM {
+		return nil, fmt.Errorf("%s: unknown encryption %q", filename, e.Encryption)
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("%s is encrypted: set %s or %s", filename, EnvPassphrase, EnvKeyFile)
+	}
+	key, err := deriveKey(secret, e.KDF, e.Salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, err := gcm.Open(nil, e.Nonce, e.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot decrypt, wrong passphrase or key file", filename)
+	}
+	return parseConfig(data)
+}
+
+// writeConfigFile writes the configuration file with configFileMode,
+// encrypting it if a key is configured.
+func writeConfigFile(filename string, c *Config) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	secret, kdf, err := storeKey()
+	if err != nil {
+		return err
+	}
+	if secret != nil {
+		e := &encryptedConfig{
+			Encryption: encryptionAESGCM,
+			KDF:        kdf,
+		}
+		if kdf == kdfScrypt {
+			e.Salt = make([]byte, 16)
+			if _, err := io.ReadFull(rand.Reader, e.Salt); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		key, err := deriveKey(secret, kdf, e.Salt)
+		if err != nil {
+			return err
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		e.Nonce = make([]byte, gcm.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, e.Nonce); err != nil {
+			return errors.WithStack(err)
+		}
+		e.Data = gcm.Seal(nil, e.Nonce, b, nil)
+		b, err = yaml.Marshal(e)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if hasSecrets(c) {
+		fmt.Fprintf(os.Stderr, "warning: credentials stored in plaintext in %s, set %s or %s to encrypt them\n", filename, EnvPassphrase, EnvKeyFile)
+	}
+
+	// written to a temporary file then renamed, so that the configuration
+	// is never left half written nor readable by others
+	return errors.WithStack(util.WriteFileAtomic(filename, b, configFileMode))
+}
+
+// enforceMode restricts the permissions of the configuration file to its owner.
+func enforceMode(filename string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if fi.Mode().Perm() != configFileMode {
+		return errors.WithStack(os.Chmod(filename, configFileMode))
+	}
+	return nil
+}
+
+// hasSecrets reports whether c holds secret keys.
+func hasSecrets(c *Config) bool {
+	for _, p := range c.Profiles {
+		if p != nil && p.SecretKey != "" {
+			return true
+		}
+	}
+	return false
+}
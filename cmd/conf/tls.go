@@ -0,0 +1,72 @@
+package conf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/tlsutil"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the TLS configuration of the settings.
+// It returns nil if none of the TLS settings is set.
+func (b *BucketConfig) tlsConfig() (*tls.Config, error) {
+	config, err := WithTLSFiles(nil, b.CertFile, b.KeyFile, b.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if b.MinTLSVersion == "" {
+		return config, nil
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config.MinVersion = tlsVersions[b.MinTLSVersion]
+	return config, nil
+}
+
+// WithTLSFiles returns a copy of config using the client certificate of the
+// certFile and keyFile pair, and trusting the CA bundle caFile in addition to
+// the system roots, e.g. with the files given by helm to downloaders.
+// Empty files are ignored and config is returned as is if all are empty.
+func WithTLSFiles(config *tls.Config, certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return config, nil
+	}
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tlsutil.CertFromFilePair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{*cert}
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read CA bundle")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA bundle %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/imroc/helm-cos/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagOlderThan time.Duration
+
+var gcUploadsCmd = &cobra.Command{
+	Use:   "gc-uploads [repository]",
+	Short: "abort abandoned multipart uploads of a repository",
+	Long: `This command lists the unfinished multipart uploads of a repository that has been added to helm
+via "helm repo add", with their initiation time, and aborts those older than --older-than.
+Their parts are stored, and billed, until they are aborted.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagOutput != "table" && flagOutput != "json" && flagOutput != "yaml" {
+			return fmt.Errorf("unknown output format \"%s\"", flagOutput)
+		}
+		repoName := args[0]
+		r, err := repo.Load(repoName)
+		if err != nil {
+			return err
+		}
+		uploads, err := r.Uploads(ctx)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		failed := 0
+		results := []gcUpload{}
+		for _, u := range uploads {
+			res := gcUpload{Upload: u, Age: "unknown", Action: "keep"}
+			if !u.Initiated.IsZero() {
+				res.Age = now.Sub(u.Initiated).Round(time.Second).String()
+			}
+			switch {
+			case u.Initiated.IsZero(), now.Sub(u.Initiated) < flagOlderThan:
+				// uploads of unknown age are kept
+			case flagDryRun:
+				res.Action = "abort"
+			default:
+				res.Action = "aborted"
+				if err := r.AbortUpload(ctx, u); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					res.Action = "failed"
+					failed++
+				}
+			}
+			results = append(results, res)
+		}
+
+		switch flagOutput {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "KEY\tUPLOAD ID\tINITIATED\tAGE\tACTION")
+			for _, res := range results {
+				initiated := "unknown"
+				if !res.Initiated.IsZero() {
+					initiated = res.Initiated.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", res.Key, res.UploadID, initiated, res.Age, res.Action)
+			}
+			err = w.Flush()
+		case "json":
+			var b []byte
+			b, err = json.MarshalIndent(results, "", "  ")
+			fmt.Println(string(b))
+		case "yaml":
+			var b []byte
+			b, err = yaml.Marshal(results)
+			fmt.Print(string(b))
+		}
+		if err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d upload(s) could not be aborted", failed)
+		}
+		return nil
+	},
+}
+
+// gcUpload is an upload listed by gc-uploads, with what has been done with
+// it: "keep", "abort" with --dry-run, "aborted" or "failed".
+type gcUpload struct {
+	*repo.Upload
+	Age    string `json:"age"`
+	Action string `json:"action"`
+}
+
+func init() {
+	RootCmd.AddCommand(gcUploadsCmd)
+	gcUploadsCmd.Flags().DurationVar(&flagOlderThan, "older-than", 24*time.Hour, "abort the uploads initiated longer ago than this")
+	gcUploadsCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "list the uploads without aborting any")
+	gcUploadsCmd.Flags().StringVarP(&flagOutput, "output", "o", "table", "output format: table, json or yaml")
+}
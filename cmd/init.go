@@ -15,7 +15,7 @@ var initCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		return repo.Create(r)
+		return repo.Create(ctx, r)
 	},
 }
 
@@ -1,43 +1,216 @@
 package cmd
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
 	"github.com/imroc/helm-cos/cmd/conf"
+	"github.com/imroc/helm-cos/pkg/cos"
 	"github.com/spf13/cobra"
-	"net/url"
 )
 
 var (
-	secretId, secretKey string
+	flagSkipVerify bool
+	flagRegion     string
+	flagAppId      string
+	flagScheme     string
+	flagEndpoint   string
+	flagCAFile     string
+	flagCertFile   string
+	flagKeyFile    string
+	flagTLSMin     string
 )
 
 var loginCmd = &cobra.Command{
 	Use:   "login cos://bucket/path",
 	Short: "login a repository",
-	Long:  `This command will login a repository on a given COS url (cos://bucket/path).`,
-	Args:  cobra.MinimumNArgs(1),
+	Long: `This command will login a repository on a given COS url (cos://bucket/path).
+The credentials given by --secretid and --secretkey are stored, otherwise they are prompted.
+They are saved in the profile given by --profile, or in a profile named after the url,
+and the profile is bound to the url: it is used for every path under it.
+The credentials are checked against the bucket before being saved: read access by listing
+the path, write access by uploading and deleting a probe object. They are not saved if
+neither works, unless --skip-verify is given.
+The settings given by --region, --appid, --scheme and --endpoint are stored for the bucket,
+e.g. to login cos://bucket/path with --region ap-guangzhou --appid 1250000000, and so are
+the TLS settings given by --ca-file, --cert-file, --key-file and --tls-min-version.`,
+	Args: cobra.MinimumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		u, err := url.Parse(args[0])
 		if err != nil {
 			return err
 		}
+		location := conf.Location(u.Host, u.Path)
+		stored, err := conf.GetBucketSettings(u.Host)
+		if err != nil {
+			return err
+		}
+		settings := *stored
+		if flagRegion != "" {
+			settings.Region = flagRegion
+		}
+		if flagAppId != "" {
+			settings.AppId = flagAppId
+		}
+		if flagScheme != "" {
+			settings.Scheme = flagScheme
+		}
+		if flagEndpoint != "" {
+			settings.Endpoint = flagEndpoint
+		}
+		// files are stored with absolute paths, to be found from any directory
+		for _, f := range []struct {
+			flag    string
+			setting *string
+		}{
+			{flagCAFile, &settings.CAFile},
+			{flagCertFile, &settings.CertFile},
+			{flagKeyFile, &settings.KeyFile},
+		} {
+			if f.flag == "" {
+				continue
+			}
+			*f.setting, err = filepath.Abs(f.flag)
+			if err != nil {
+				return err
+			}
+		}
+		if flagTLSMin != "" {
+			settings.MinTLSVersion = flagTLSMin
+		}
+		err = settings.Validate()
+		if err != nil {
+			return err
+		}
+
+		var cosConfig *conf.CosConfig
 		if secretId != "" && secretKey != "" { // update credentials with the flag
-			err = conf.UpdateBucketConfig(u.Host, &conf.CosConfig{
+			cosConfig = &conf.CosConfig{
 				SecretId:  secretId,
 				SecretKey: secretKey,
-			})
-			if err != nil {
+			}
+		} else {
+			cosConfig, err = conf.PromptCosConfig(location)
+			if err != nil || cosConfig == nil {
 				return err
 			}
-			return nil
 		}
 
-		conf.InputCosConfig(u.Host)
-		return nil
+		if !flagSkipVerify {
+			client, err := conf.NewCosClient(location, cosConfig, &settings)
+			if err != nil {
+				return err
+			}
+			err = checkAccess(client.Bucket(""), u.Path)
+			if err != nil {
+				return err
+			}
+		}
+		if settings != *stored {
+			err = conf.UpdateBucketSettings(u.Host, &settings)
+			if err != nil {
+				return err
+			}
+		}
+		return conf.UpdateBucketConfig(location, cosConfig)
 	},
 }
 
+// checkAccess reports whether the credentials of bkt can read and write
+// under the path p. It fails if they are rejected by either check, if they
+// can do neither, or if the bucket can't be reached.
+func checkAccess(bkt *cos.Bucket, p string) error {
+	prefix := strings.Trim(p, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	_, readErr := bkt.ListWithContext(ctx, prefix, "/", "", 1)
+	printAccess("read", readErr)
+
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return err
+	}
+	probe := path.Join("/", p, ".helm-cos-login-"+hex.EncodeToString(b))
+	writeErr := bkt.PutWithContext(ctx, probe, []byte{}, "text/plain", cos.Private, cos.Options{})
+	if writeErr == nil {
+		// not cancelled, so that the probe is not left behind
+		err = bkt.DelWithContext(context.Background(), probe)
+		if err != nil {
+			fmt.Printf("warning: failed to delete probe object %s: %v\n", probe, err)
+		}
+	}
+	printAccess("write", writeErr)
+
+	const notSaved = "credentials not saved (use --skip-verify to save them anyway)"
+	for _, err := range []error{readErr, writeErr} {
+		if isInvalidCredentials(err) {
+			return errors.New("authentication failed, " + notSaved)
+		}
+	}
+	for _, err := range []error{readErr, writeErr} {
+		if err != nil && cos.AsError(err) == nil {
+			return fmt.Errorf("bucket unreachable (%v), %s", err, notSaved)
+		}
+	}
+	if readErr != nil && writeErr != nil {
+		if cos.IsAccessDenied(readErr) && cos.IsAccessDenied(writeErr) {
+			return errors.New("access denied, " + notSaved)
+		}
+		return fmt.Errorf("access check failed (%v), %s", readErr, notSaved)
+	}
+	return nil
+}
+
+// isInvalidCredentials reports whether err is caused by credentials that are
+// unknown or whose signature doesn't match, rather than not allowed.
+func isInvalidCredentials(err error) bool {
+	e := cos.AsError(err)
+	if e == nil {
+		return false
+	}
+	switch e.Code {
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return true
+	}
+	return e.StatusCode == http.StatusUnauthorized
+}
+
+func printAccess(access string, err error) {
+	if err == nil {
+		fmt.Printf("%s access: ok\n", access)
+		return
+	}
+	if cos.IsAccessDenied(err) {
+		e := cos.AsError(err)
+		fmt.Printf("%s access: denied (%s: %s)\n", access, e.Code, e.Message)
+		return
+	}
+	if cos.AsError(err) == nil {
+		fmt.Printf("%s access: unknown, network error (%v)\n", access, err)
+		return
+	}
+	fmt.Printf("%s access: failed (%v)\n", access, err)
+}
+
 func init() {
 	RootCmd.AddCommand(loginCmd)
-	loginCmd.Flags().StringVar(&secretId, "secretid", "", "COS SecretId")
-	loginCmd.Flags().StringVar(&secretKey, "secretkey", "", "COS SecretKey")
+	loginCmd.Flags().StringVar(&flagRegion, "region", "", "region of the bucket, e.g. ap-guangzhou")
+	loginCmd.Flags().StringVar(&flagAppId, "appid", "", "AppId appended to the bucket name")
+	loginCmd.Flags().StringVar(&flagScheme, "scheme", "", "scheme of the requests to the bucket, https (default) or http")
+	loginCmd.Flags().StringVar(&flagEndpoint, "endpoint", "", "host to send the requests to, instead of the one of the bucket")
+	loginCmd.Flags().StringVar(&flagCAFile, "ca-file", "", "trust the certificate authorities of this PEM bundle")
+	loginCmd.Flags().StringVar(&flagCertFile, "cert-file", "", "identify with this PEM client certificate")
+	loginCmd.Flags().StringVar(&flagKeyFile, "key-file", "", "PEM key of the client certificate")
+	loginCmd.Flags().StringVar(&flagTLSMin, "tls-min-version", "", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	loginCmd.Flags().BoolVar(&flagSkipVerify, "skip-verify", false, "save the credentials without checking them against the bucket")
 }
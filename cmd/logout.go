@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/imroc/helm-cos/cmd/conf"
+	"github.com/spf13/cobra"
+)
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout [cos://bucket/path]",
+	Short: "logout a repository",
+	Long: `This command removes the credentials stored for a given COS url (cos://bucket/path).
+With --profile, the profile and all its bindings are removed.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			if conf.Profile == "" {
+				return errors.New("a COS url or a profile is required")
+			}
+			return conf.DeleteProfile(conf.Profile)
+		}
+		u, err := url.Parse(args[0])
+		if err != nil {
+			return err
+		}
+		return conf.DeleteBucketConfig(conf.Location(u.Host, u.Path))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(logoutCmd)
+}
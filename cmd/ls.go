@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/imroc/helm-cos/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagOutput string
+
+var lsCmd = &cobra.Command{
+	Use:     "ls [repository] [chart]",
+	Aliases: []string{"list"},
+	Short:   "list charts of a repository",
+	Long: `This command lists the charts of a repository that has been added to helm via "helm repo add",
+reading the index file directly from COS.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoName, chart := args[0], ""
+		if len(args) > 1 {
+			chart = args[1]
+		}
+		r, err := repo.Load(repoName)
+		if err != nil {
+			return err
+		}
+		cvs, err := r.ListCharts(ctx, chart, flagVersion)
+		if err != nil {
+			return err
+		}
+
+		switch flagOutput {
+		case "table":
+			w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tVERSION\tAPP VERSION\tCREATED\tDIGEST")
+			for _, cv := range cvs {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", cv.Name, cv.Version, cv.AppVersion, cv.Created.Format(time.RFC3339), cv.Digest)
+			}
+			return w.Flush()
+		case "json":
+			b, err := json.MarshalIndent(cvs, "", "  ")
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(b))
+		case "yaml":
+			b, err := yaml.Marshal(cvs)
+			if err != nil {
+				return err
+			}
+			fmt.Print(string(b))
+		default:
+			return fmt.Errorf("unknown output format \"%s\"", flagOutput)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().StringVarP(&flagVersion, "version", "v", "", "semver constraint the versions must match")
+	lsCmd.Flags().StringVarP(&flagOutput, "output", "o", "table", "output format: table, json or yaml")
+}
@@ -21,38 +21,137 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/imroc/helm-cos/cmd/conf"
+	"github.com/imroc/helm-cos/pkg/repo"
 	"github.com/spf13/cobra"
 	"net/url"
 )
 
+var (
+	flagNoVerify    bool
+	flagPullKeyring string
+)
+
 var pullCmd = &cobra.Command{
-	Use:   "pull cos://bucket/path",
+	Use:   "pull [certFile keyFile caFile] cos://bucket/path",
 	Short: "prints a file on stdout",
 	Long: `This command pull a file from COS and prints it to stdout.
-Used by helm to fetch charts from COS.`,
+Used by helm to fetch charts from COS, as a downloader called with certFile, keyFile, caFile and the URL.
+The digest of charts listed in the index file of the repository is verified.
+If a keyring is given, charts must also have a valid provenance file.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 && len(args) != 4 {
+			return fmt.Errorf("accepts 1 or 4 args, received %d", len(args))
+		}
+		return nil
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
-		u, err := url.Parse(args[0])
+		var certFile, keyFile, caFile string
+		if len(args) == 4 {
+			certFile, keyFile, caFile = args[0], args[1], args[2]
+		}
+		u, err := url.Parse(args[len(args)-1])
+		if err != nil {
+			return err
+		}
+		// credentials are resolved, and bound if prompted, for the repository
+		// of the chart rather than for the chart itself
+		client, err := conf.GetCosClient(conf.Location(u.Host, path.Dir(u.Path)))
 		if err != nil {
 			return err
 		}
-		client, err := conf.GetCosClient(u.Host)
+		client.TLSClientConfig, err = conf.WithTLSFiles(client.TLSClientConfig, certFile, keyFile, caFile)
 		if err != nil {
 			return err
 		}
 		bkt := client.Bucket("")
-		rc, err := bkt.GetReader(u.Path)
+		// only chart archives are indexed, and verified
+		isChart := strings.HasSuffix(u.Path, ".tgz")
+		digest := ""
+		// helm does not pass flags to downloaders, so verification can also be disabled by env
+		if isChart && !flagNoVerify && strings.ToLower(os.Getenv("HELM_COS_NO_VERIFY")) != "true" {
+			digest, err = repo.IndexedDigest(ctx, bkt, u.Path)
+			if err != nil {
+				return err
+			}
+		}
+		keyring := flagPullKeyring
+		if keyring == "" {
+			keyring = os.Getenv("HELM_COS_KEYRING")
+		}
+		if !isChart {
+			keyring = ""
+		}
+		rc, err := bkt.GetResumableReaderWithContext(ctx, u.Path)
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(os.Stdout, rc)
+		defer rc.Close()
+		if digest == "" && keyring == "" {
+			_, err = io.Copy(os.Stdout, rc)
+			return err
+		}
+
+		// the chart is buffered so that nothing is printed if it can't be verified
+		dir, err := ioutil.TempDir("", "helm-cos-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		chartfile := filepath.Join(dir, path.Base(u.Path))
+		err = downloadVerified(chartfile, rc, digest)
+		if err != nil {
+			return err
+		}
+		if keyring != "" {
+			_, err = repo.VerifyProvenance(ctx, bkt, u.Path, chartfile, keyring)
+			if err != nil {
+				return err
+			}
+		}
+		f, err := os.Open(chartfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
 		return err
 	},
 }
 
+// downloadVerified writes src to the file filename.
+// If digest is not empty, it fails if the SHA-256 of the content doesn't match.
+func downloadVerified(filename string, src io.Reader, digest string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), src)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if digest != "" && sum != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, sum)
+	}
+	return nil
+}
+
 func init() {
 	RootCmd.AddCommand(pullCmd)
+	pullCmd.Flags().BoolVar(&flagNoVerify, "no-verify", false, "do not verify the digest of indexed charts")
+	pullCmd.Flags().StringVar(&flagPullKeyring, "keyring", "", "verify the provenance of charts with this public keyring (default $HELM_COS_KEYRING)")
 }
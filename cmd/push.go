@@ -21,12 +21,27 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/imroc/helm-cos/pkg/cos"
 	"github.com/imroc/helm-cos/pkg/repo"
 	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh/terminal"
+	"k8s.io/client-go/util/homedir"
 )
 
 var (
-	flagForce bool
+	flagForce       bool
+	flagRetry       bool
+	flagSign        bool
+	flagKey         string
+	flagKeyring     string
+	flagPartSize    int64
+	flagConcurrency int
 )
 
 var pushCmd = &cobra.Command{
@@ -36,11 +51,30 @@ var pushCmd = &cobra.Command{
 	Args:  cobra.MinimumNArgs(2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		chartpath, repoName := args[0], args[1]
+		if flagSign && flagKey == "" {
+			return errors.New("--sign requires --key, the name of the signing key")
+		}
 		r, err := repo.Load(repoName)
 		if err != nil {
 			return err
 		}
-		err = r.PushChart(chartpath, repoName, flagForce)
+		repo.PartSize = flagPartSize << 20
+		repo.UploadConcurrency = flagConcurrency
+		prov := ""
+		if flagSign {
+			prov, err = repo.Sign(chartpath, flagKeyring, flagKey, promptPassphrase)
+			if err != nil {
+				return err
+			}
+		}
+		push := func() error {
+			return r.PushChart(ctx, chartpath, repoName, flagForce, prov)
+		}
+		if flagRetry {
+			err = withRetry(push)
+		} else {
+			err = push()
+		}
 		if err != nil {
 			return err
 		}
@@ -51,4 +85,26 @@ var pushCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(pushCmd)
 	pushCmd.Flags().BoolVar(&flagForce, "force", false, "upload the chart even if already indexed")
+	pushCmd.Flags().BoolVar(&flagRetry, "retry", false, "retry if the index has been updated at the same time")
+	pushCmd.Flags().BoolVar(&flagSign, "sign", false, "sign the chart and upload its provenance file")
+	pushCmd.Flags().StringVar(&flagKey, "key", "", "name of the key to use when signing")
+	pushCmd.Flags().StringVar(&flagKeyring, "keyring", defaultKeyring("secring.gpg"), "location of a secret keyring")
+	pushCmd.Flags().Int64Var(&flagPartSize, "part-size", cos.DefaultPartSize>>20, "size in MiB of the parts of charts uploaded in parts")
+	pushCmd.Flags().IntVar(&flagConcurrency, "concurrency", cos.DefaultUploadConcurrency, "number of parts uploaded at once")
+}
+
+// promptPassphrase reads the passphrase of a signing key from HELM_KEY_PASSPHRASE,
+// or from the terminal if it is not set.
+func promptPassphrase(name string) ([]byte, error) {
+	if p, ok := os.LookupEnv("HELM_KEY_PASSPHRASE"); ok {
+		return []byte(p), nil
+	}
+	fmt.Printf("Password for key %q: ", name)
+	pw, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	return pw, err
+}
+
+func defaultKeyring(name string) string {
+	return filepath.Join(homedir.HomeDir(), ".gnupg", name)
 }
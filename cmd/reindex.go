@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/imroc/helm-cos/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagDryRun bool
+	flagMerge  bool
+)
+
+var reindexCmd = &cobra.Command{
+	Use:   "reindex [repository]",
+	Short: "rebuild the index of a repository",
+	Long: `This command rebuilds the index file of a repository that has been added to helm via "helm repo add",
+from the chart archives stored in the bucket.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		repoName := args[0]
+		r, err := repo.Load(repoName)
+		if err != nil {
+			return err
+		}
+		return r.Reindex(ctx, repoName, flagMerge, flagDryRun)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reindexCmd)
+	reindexCmd.Flags().BoolVar(&flagDryRun, "dry-run", false, "print the changes without updating the index")
+	reindexCmd.Flags().BoolVar(&flagMerge, "merge", false, "keep the entries of the current index")
+}
@@ -40,11 +40,18 @@ If no specific version is given, all versions will be removed.`,
 		if err != nil {
 			return err
 		}
-		return r.RemoveChart(chart, repoName, flagVersion)
+		remove := func() error {
+			return r.RemoveChart(ctx, chart, repoName, flagVersion)
+		}
+		if flagRetry {
+			return withRetry(remove)
+		}
+		return remove()
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(rmCmd)
 	rmCmd.Flags().StringVarP(&flagVersion, "version", "v", "", "version of the chart to remove")
+	rmCmd.Flags().BoolVar(&flagRetry, "retry", false, "retry if the index has been updated at the same time")
 }
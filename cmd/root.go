@@ -21,38 +21,139 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/imroc/helm-cos/cmd/conf"
 	"github.com/imroc/helm-cos/pkg/repo"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 )
 
 var (
-	flagDebug bool
+	flagDebug             bool
+	flagNonInteractive    bool
+	flagProfile           string
+	flagPlainHTTP         bool
+	flagInsecurePlaintext bool
+	flagMaxAttempts       int
+	flagRetryElapsed      string
+
+	secretId, secretKey string
+)
+
+// ctx is the context of the running command, cancelled on SIGINT or SIGTERM.
+var ctx = context.Background()
+
+const (
+	maxRetries     = 10
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
 )
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
 	Use:   "helm-cos",
 	Short: "Manage Helm repositories on Google Cloud Storage",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// zero means the default when the flag is not given, not when it is
+		if cmd.Flags().Changed("max-attempts") && flagMaxAttempts <= 0 {
+			return fmt.Errorf("--max-attempts: invalid number of attempts %d", flagMaxAttempts)
+		}
+		return nil
+	},
 	//	Run: func(cmd *cobra.Command, args []string) { },
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
+	var cancel context.CancelFunc
+	ctx, cancel = withSignals(context.Background())
+	err := RootCmd.Execute()
+	cancel()
+	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// withSignals returns a copy of parent which is cancelled on the first SIGINT
+// or SIGTERM received. The process exits on the second one.
+func withSignals(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sigs:
+			// stdout may be the chart being pulled
+			fmt.Fprintf(os.Stderr, "%s received, cancelling (repeat to exit immediately)\n", s)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		<-sigs
+		os.Exit(130)
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+// withRetry calls fn until it succeeds or fails with an error other than
+// repo.ErrIndexOutOfDate, waiting longer and longer between attempts.
+// Waiting is interrupted when ctx is cancelled.
+// fn must reload the index of the repository before each attempt.
+func withRetry(fn func() error) error {
+	delay := retryBaseDelay
+	for n := 1; ; n++ {
+		err := fn()
+		if errors.Cause(err) != repo.ErrIndexOutOfDate || n >= maxRetries {
+			return err
+		}
+		fmt.Printf("index is out-of-date, retrying in %s...\n", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
 func init() {
 	cobra.OnInitialize(func() {
 		if flagDebug {
 			repo.Debug = true
 		}
+		conf.SetFlagCredentials(secretId, secretKey)
+		conf.NonInteractive = flagNonInteractive || strings.ToLower(os.Getenv("HELM_COS_NON_INTERACTIVE")) == "true"
+		conf.PlainHTTP = flagPlainHTTP || strings.ToLower(os.Getenv("HELM_COS_PLAIN_HTTP")) == "true"
+		conf.InsecurePlaintext = flagInsecurePlaintext || strings.ToLower(os.Getenv("HELM_COS_INSECURE_PLAINTEXT")) == "true"
+		conf.Retry.MaxAttempts = flagMaxAttempts
+		conf.Retry.MaxElapsed = flagRetryElapsed
+		conf.Profile = flagProfile
+		if conf.Profile == "" {
+			conf.Profile = os.Getenv("HELM_COS_PROFILE")
+		}
 	})
 	RootCmd.PersistentFlags().BoolVar(&flagDebug, "debug", false, "activate debug")
+	RootCmd.PersistentFlags().BoolVar(&flagNonInteractive, "non-interactive", false, "fail instead of prompting for credentials")
+	RootCmd.PersistentFlags().StringVar(&secretId, "secretid", "", "COS SecretId")
+	RootCmd.PersistentFlags().StringVar(&secretKey, "secretkey", "", "COS SecretKey")
+	RootCmd.PersistentFlags().BoolVar(&flagPlainHTTP, "plain-http", false, "send requests over HTTP instead of HTTPS (insecure)")
+	RootCmd.PersistentFlags().BoolVar(&flagInsecurePlaintext, "insecure-plaintext", false, "allow storing credentials unencrypted when no passphrase or key file is set")
+	RootCmd.PersistentFlags().IntVar(&flagMaxAttempts, "max-attempts", 0, "maximum number of attempts of failed COS requests (default $HELM_COS_MAX_ATTEMPTS or 5)")
+	RootCmd.PersistentFlags().StringVar(&flagRetryElapsed, "retry-max-elapsed", "", "time after which failed COS requests are not retried, e.g. 2m (default $HELM_COS_RETRY_MAX_ELAPSED or 1m)")
+	RootCmd.PersistentFlags().StringVar(&flagProfile, "profile", "", "name of the stored credentials to use (default $HELM_COS_PROFILE or the profile bound to the bucket)")
 }
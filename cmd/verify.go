@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/imroc/helm-cos/cmd/conf"
+	"github.com/imroc/helm-cos/pkg/repo"
+	"github.com/spf13/cobra"
+)
+
+var flagVerifyKeyring string
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify cos://bucket/path/chart.tgz",
+	Short: "verify the provenance of a chart",
+	Long: `This command downloads a chart and its provenance file from COS,
+and verifies that the chart has been signed by a key of the keyring.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		u, err := url.Parse(args[0])
+		if err != nil {
+			return err
+		}
+		// credentials are resolved, and bound if prompted, for the repository
+		// of the chart rather than for the chart itself
+		client, err := conf.GetCosClient(conf.Location(u.Host, path.Dir(u.Path)))
+		if err != nil {
+			return err
+		}
+		bkt := client.Bucket("")
+		rc, err := bkt.GetReaderWithContext(ctx, u.Path)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		dir, err := ioutil.TempDir("", "helm-cos-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		chartfile := filepath.Join(dir, path.Base(u.Path))
+		err = downloadVerified(chartfile, rc, "")
+		if err != nil {
+			return err
+		}
+		v, err := repo.VerifyProvenance(ctx, bkt, u.Path, chartfile, flagVerifyKeyring)
+		if err != nil {
+			return err
+		}
+		for name := range v.SignedBy.Identities {
+			fmt.Printf("Signed by: %v\n", name)
+		}
+		fmt.Printf("Using Key With Fingerprint: %X\n", v.SignedBy.PrimaryKey.Fingerprint)
+		fmt.Printf("Chart Hash Verified: %s\n", v.FileHash)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVar(&flagVerifyKeyring, "keyring", defaultKeyring("pubring.gpg"), "keyring containing public keys")
+}
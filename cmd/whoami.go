@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/imroc/helm-cos/cmd/conf"
+	"github.com/spf13/cobra"
+)
+
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami cos://bucket/path",
+	Short: "show the credentials used for a repository",
+	Long:  `This command shows where the credentials used for a given COS url (cos://bucket/path) come from.`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		u, err := url.Parse(args[0])
+		if err != nil {
+			return err
+		}
+		location := conf.Location(u.Host, u.Path)
+		conf.NonInteractive = true
+		c, err := conf.GetBucketConfig(location)
+		if err != nil {
+			return err
+		}
+		client, err := conf.GetCosClient(location)
+		if err != nil {
+			return err
+		}
+		fmt.Println("source:", c.Source)
+		fmt.Println("secret id:", maskSecret(c.SecretId))
+		fmt.Println("endpoint:", client.GetEndpoint(""))
+		if c.Expiration != nil {
+			fmt.Println("expiration:", c.Expiration)
+		}
+		return nil
+	},
+}
+
+// maskSecret hides all but the first and last 4 characters of s.
+func maskSecret(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + strings.Repeat("*", len(s)-8) + s[len(s)-4:]
+}
+
+func init() {
+	RootCmd.AddCommand(whoamiCmd)
+}
@@ -1,6 +1,7 @@
 package cos
 
 import (
+	"context"
 	"time"
 )
 
@@ -9,14 +10,21 @@ import (
 // AttemptStrategy represents a strategy for waiting for an action
 // to complete successfully. This is an internal type used by the
 // implementation of other packages.
+//
+// Deprecated: requests are retried according to Client.RetryPolicy, this
+// type is no longer used by the package and is only kept for compatibility.
 type AttemptStrategy struct {
 	Total time.Duration // total duration of attempt.
 	Delay time.Duration // interval between each try in the burst.
 	Min   int           // minimum number of retries; overrides Total
 }
 
+// Attempt is a sequence of attempts started by AttemptStrategy.
+//
+// Deprecated: see AttemptStrategy.
 type Attempt struct {
 	strategy AttemptStrategy
+	ctx      context.Context
 	last     time.Time
 	end      time.Time
 	force    bool
@@ -25,9 +33,16 @@ type Attempt struct {
 
 // Start begins a new sequence of attempts for the given strategy.
 func (s AttemptStrategy) Start() *Attempt {
+	return s.StartWithContext(context.Background())
+}
+
+// StartWithContext is like Start, but no attempt is made once ctx is done,
+// and waiting for the next one is interrupted.
+func (s AttemptStrategy) StartWithContext(ctx context.Context) *Attempt {
 	now := time.Now()
 	return &Attempt{
 		strategy: s,
+		ctx:      ctx,
 		last:     now,
 		end:      now.Add(s.Total),
 		force:    true,
@@ -37,6 +52,9 @@ func (s AttemptStrategy) Start() *Attempt {
 // Next waits until it is time to perform the next attempt or returns
 // false if it is time to stop trying.
 func (a *Attempt) Next() bool {
+	if a.ctx.Err() != nil {
+		return false
+	}
 	now := time.Now()
 	sleep := a.nextSleep(now)
 	if !a.force && !now.Add(sleep).Before(a.end) && a.strategy.Min <= a.count {
@@ -44,7 +62,13 @@ func (a *Attempt) Next() bool {
 	}
 	a.force = false
 	if sleep > 0 && a.count > 0 {
-		time.Sleep(sleep)
+		t := time.NewTimer(sleep)
+		select {
+		case <-t.C:
+		case <-a.ctx.Done():
+			t.Stop()
+			return false
+		}
 		now = time.Now()
 	}
 	a.count++
@@ -64,6 +88,9 @@ func (a *Attempt) nextSleep(now time.Time) time.Duration {
 // one fails. If it returns true, the following call to Next is
 // guaranteed to return true.
 func (a *Attempt) HasNext() bool {
+	if a.ctx.Err() != nil {
+		return false
+	}
 	if a.force || a.strategy.Min > a.count {
 		return true
 	}
@@ -74,3 +101,8 @@ func (a *Attempt) HasNext() bool {
 	}
 	return false
 }
+
+// Err returns the error of the context of the attempts once it is done, nil otherwise.
+func (a *Attempt) Err() error {
+	return a.ctx.Err()
+}
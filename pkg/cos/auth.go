@@ -13,6 +13,9 @@ func (client *Client) signRequest(request *request) {
 
 	//request.headers.Set("Date", GetGMTime())
 	request.headers.Set("Host", client.GetHost(request.bucket))
+	if client.SessionToken != "" {
+		request.headers.Set(SecurityTokenHeader, client.SessionToken)
+	}
 
 	request.BuildAuth(client.AccessKeyId, client.AccessKeySecret)
 
@@ -165,6 +168,9 @@ func (req *request) buildParamList() {
 }
 
 func (client *Client) signURLRequest(request *request) {
+	if client.SessionToken != "" {
+		request.params.Set(SecurityTokenHeader, client.SessionToken)
+	}
 
 	request.BuildAuth(client.AccessKeyId, client.AccessKeySecret)
 
@@ -184,6 +190,10 @@ const (
 	SignAlgorithm = "sha1"
 
 	URLSignPara = "sign"
+
+	// SecurityTokenHeader carries the session token of temporary credentials,
+	// as a header or as a parameter of signed URLs.
+	SecurityTokenHeader = "x-cos-security-token"
 )
 
 func (req *request) buildAuthorization(secretId string) {
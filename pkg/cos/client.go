@@ -2,11 +2,14 @@ package cos
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
+	"crypto/tls"
 	//"crypto/sha1"
 	"encoding/base64"
 	//"encoding/hex"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +20,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,18 +29,49 @@ const DefaultSignExpireTime = 86400
 
 var DEBUG bool
 
+// ErrCredentialsExpired is returned when a request is made with temporary
+// credentials that have expired.
+var ErrCredentialsExpired = errors.New("credentials expired")
+
 // The Client type encapsulates operations with an COS region.
 type Client struct {
 	AppId           string
 	AccessKeyId     string
 	AccessKeySecret string
-	Region          Region
-	Secure          bool
-	ConnectTimeout  time.Duration
+	// SessionToken is the token of temporary credentials obtained from STS.
+	SessionToken string
+	// Expiration is the time temporary credentials expire at, zero if they don't.
+	Expiration     time.Time
+	Region         Region
+	Secure         bool
+	ConnectTimeout time.Duration
+	// TLSClientConfig is the TLS configuration used for HTTPS requests.
+	// If nil, the default configuration is used.
+	TLSClientConfig *tls.Config
+
+	// Transport sends the requests. If nil, a keep-alive transport shared by
+	// all the requests of the client is built on first use, from
+	// ConnectTimeout, TLSClientConfig and the connection limits below, which
+	// must not be changed afterwards.
+	Transport http.RoundTripper
+	// MaxIdleConns and MaxIdleConnsPerHost limit the idle connections kept
+	// for reuse, MaxConnsPerHost the connections to a host. Zero means the
+	// default, respectively 100, 16 and no limit.
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	// IdleConnTimeout is how long an idle connection is kept, 90s if zero.
+	IdleConnTimeout time.Duration
+	// RetryPolicy decides whether and when failed requests are retried.
+	// If nil, DefaultRetryPolicy is used.
+	RetryPolicy *RetryPolicy
 
 	host     string
 	endpoint string
 	Debug    bool
+
+	transportOnce    sync.Once
+	defaultTransport http.RoundTripper
 }
 
 // The Bucket type encapsulates operations with an bucket.
@@ -61,9 +96,15 @@ func (client *Client) GetHost(bucket string) string {
 }
 
 func (b *Bucket) Head(path string, headers http.Header) (*http.Response, error) {
+	return b.HeadWithContext(context.Background(), path, headers)
+}
 
-	for attempt := attempts.Start(); attempt.Next(); {
+// HeadWithContext is like Head, the request is cancelled when ctx is done.
+func (b *Bucket) HeadWithContext(ctx context.Context, path string, headers http.Header) (*http.Response, error) {
+	attempt := b.Client.retries(ctx)
+	for attempt.Next() {
 		req := &request{
+			ctx:     ctx,
 			method:  "HEAD",
 			bucket:  b.Name,
 			path:    path,
@@ -76,7 +117,7 @@ func (b *Bucket) Head(path string, headers http.Header) (*http.Response, error)
 		}
 
 		resp, err := b.Client.run(req, nil)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		if err != nil {
@@ -87,14 +128,19 @@ func (b *Bucket) Head(path string, headers http.Header) (*http.Response, error)
 		}
 		return resp, err
 	}
-	return nil, fmt.Errorf("Currently Unreachable")
+	return nil, attempt.Err()
 }
 
 // Get retrieves an object from an bucket.
 //
 // You can read doc at https://www.qcloud.com/document/product/436/7753
 func (b *Bucket) Get(path string) (data []byte, err error) {
-	body, err := b.GetReader(path)
+	return b.GetWithContext(context.Background(), path)
+}
+
+// GetWithContext is like Get, the request is cancelled when ctx is done.
+func (b *Bucket) GetWithContext(ctx context.Context, path string) (data []byte, err error) {
+	body, err := b.GetReaderWithContext(ctx, path)
 	if err != nil {
 		return nil, err
 	}
@@ -108,7 +154,13 @@ func (b *Bucket) Get(path string) (data []byte, err error) {
 // It is the caller's responsibility to call Close on rc when
 // finished reading.
 func (b *Bucket) GetReader(path string) (rc io.ReadCloser, err error) {
-	resp, err := b.GetResponse(path)
+	return b.GetReaderWithContext(context.Background(), path)
+}
+
+// GetReaderWithContext is like GetReader, the request, including reading the
+// body, is cancelled when ctx is done.
+func (b *Bucket) GetReaderWithContext(ctx context.Context, path string) (rc io.ReadCloser, err error) {
+	resp, err := b.GetResponseWithContext(ctx, path, make(http.Header))
 	if resp != nil {
 		return resp.Body, err
 	}
@@ -129,8 +181,16 @@ func (b *Bucket) GetResponse(path string) (resp *http.Response, err error) {
 // It is the caller's responsibility to call Close on rc when
 // finished reading
 func (b *Bucket) GetResponseWithHeaders(path string, headers http.Header) (resp *http.Response, err error) {
-	for attempt := attempts.Start(); attempt.Next(); {
+	return b.GetResponseWithContext(context.Background(), path, headers)
+}
+
+// GetResponseWithContext is like GetResponseWithHeaders, the request,
+// including reading the body, is cancelled when ctx is done.
+func (b *Bucket) GetResponseWithContext(ctx context.Context, path string, headers http.Header) (resp *http.Response, err error) {
+	attempt := b.Client.retries(ctx)
+	for attempt.Next() {
 		req := &request{
+			ctx:     ctx,
 			bucket:  b.Name,
 			path:    path,
 			headers: headers,
@@ -142,7 +202,7 @@ func (b *Bucket) GetResponseWithHeaders(path string, headers http.Header) (resp
 		}
 
 		resp, err := b.Client.run(req, nil)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		if err != nil {
@@ -150,7 +210,7 @@ func (b *Bucket) GetResponseWithHeaders(path string, headers http.Header) (resp
 		}
 		return resp, nil
 	}
-	panic("unreachable")
+	return nil, attempt.Err()
 }
 
 // Options struct
@@ -161,6 +221,8 @@ type Options struct {
 	CacheControl       string
 	COSContentSHA1     string
 	ContentDisposition string
+	IfMatch            string
+	ForbidOverwrite    bool
 
 	//Expires string
 	//Expect  string
@@ -180,6 +242,12 @@ func (o Options) addHeaders(headers http.Header) {
 	if len(o.ContentDisposition) != 0 {
 		headers.Set("Content-Disposition", o.ContentDisposition)
 	}
+	if len(o.IfMatch) != 0 {
+		headers.Set("If-Match", o.IfMatch)
+	}
+	if o.ForbidOverwrite {
+		headers.Set("x-cos-forbid-overwrite", "true")
+	}
 
 	for k, v := range o.Meta {
 		for _, mv := range v {
@@ -220,13 +288,23 @@ const (
 )
 
 func (b *Bucket) Put(path string, data []byte, contType string, perm ACL, options Options) error {
-	body := bytes.NewBuffer(data)
-	return b.PutReader(path, body, int64(len(data)), contType, perm, options)
+	return b.PutWithContext(context.Background(), path, data, contType, perm, options)
+}
+
+// PutWithContext is like Put, the request is cancelled when ctx is done.
+func (b *Bucket) PutWithContext(ctx context.Context, path string, data []byte, contType string, perm ACL, options Options) error {
+	body := bytes.NewReader(data)
+	return b.PutReaderWithContext(ctx, path, body, int64(len(data)), contType, perm, options)
 }
 
 // PutReader inserts an object into the bucket by consuming data
-// from r until EOF.
+// from r until EOF. The request is retried only if r is an io.Seeker.
 func (b *Bucket) PutReader(path string, r io.Reader, length int64, contType string, perm ACL, options Options) error {
+	return b.PutReaderWithContext(context.Background(), path, r, length, contType, perm, options)
+}
+
+// PutReaderWithContext is like PutReader, the request is cancelled when ctx is done.
+func (b *Bucket) PutReaderWithContext(ctx context.Context, path string, r io.Reader, length int64, contType string, perm ACL, options Options) error {
 	headers := make(http.Header)
 	headers.Set("Content-Length", strconv.FormatInt(length, 10))
 	headers.Set("Content-Type", contType)
@@ -234,6 +312,7 @@ func (b *Bucket) PutReader(path string, r io.Reader, length int64, contType stri
 
 	options.addHeaders(headers)
 	req := &request{
+		ctx:     ctx,
 		method:  "PUT",
 		bucket:  b.Name,
 		path:    path,
@@ -241,13 +320,18 @@ func (b *Bucket) PutReader(path string, r io.Reader, length int64, contType stri
 		payload: r,
 		expire:  time.Now().Add(DefaultSignExpireTime * time.Second),
 	}
-	return b.Client.query(req, nil)
+	return b.Client.queryWithRetry(req, nil)
 }
 
 // PutCopy puts a copy of an object given by the key path into bucket b using b.Path as the target key
 //
 //
 func (b *Bucket) PutCopy(path string, perm ACL, options CopyOptions, source string) (*CopyObjectResult, error) {
+	return b.PutCopyWithContext(context.Background(), path, perm, options, source)
+}
+
+// PutCopyWithContext is like PutCopy, the request is cancelled when ctx is done.
+func (b *Bucket) PutCopyWithContext(ctx context.Context, path string, perm ACL, options CopyOptions, source string) (*CopyObjectResult, error) {
 	headers := make(http.Header)
 
 	//headers.Set("x-cos-acl", string(perm))
@@ -255,6 +339,7 @@ func (b *Bucket) PutCopy(path string, perm ACL, options CopyOptions, source stri
 
 	options.addHeaders(headers)
 	req := &request{
+		ctx:     ctx,
 		method:  "PUT",
 		bucket:  b.Name,
 		path:    path,
@@ -291,15 +376,20 @@ func makeXMLBuffer(doc []byte) *bytes.Buffer {
 //
 //
 func (b *Bucket) DelMulti(objects Delete) error {
+	return b.DelMultiWithContext(context.Background(), objects)
+}
+
+// DelMultiWithContext is like DelMulti, the request is cancelled when ctx is done.
+func (b *Bucket) DelMultiWithContext(ctx context.Context, objects Delete) error {
 	doc, err := xml.Marshal(objects)
 	if err != nil {
 		return err
 	}
 
-	buf := makeXMLBuffer(doc)
+	buf := bytes.NewReader(makeXMLBuffer(doc).Bytes())
 	//digest := sha1.New()
 	digest := md5.New()
-	size, err := digest.Write(buf.Bytes())
+	size, err := digest.Write(makeXMLBuffer(doc).Bytes())
 	if err != nil {
 		return err
 	}
@@ -312,6 +402,7 @@ func (b *Bucket) DelMulti(objects Delete) error {
 	headers.Set("Content-Type", "text/xml")
 
 	req := &request{
+		ctx:     ctx,
 		path:    "/",
 		method:  "POST",
 		params:  url.Values{"delete": {""}},
@@ -321,17 +412,23 @@ func (b *Bucket) DelMulti(objects Delete) error {
 		expire:  time.Now().Add(DefaultSignExpireTime * time.Second),
 	}
 
-	return b.Client.query(req, nil)
+	return b.Client.queryWithRetry(req, nil)
 }
 
 func (b *Bucket) Del(path string) error {
+	return b.DelWithContext(context.Background(), path)
+}
+
+// DelWithContext is like Del, the request is cancelled when ctx is done.
+func (b *Bucket) DelWithContext(ctx context.Context, path string) error {
 	req := &request{
+		ctx:    ctx,
 		method: "DELETE",
 		bucket: b.Name,
 		path:   path,
 		expire: time.Now().Add(DefaultSignExpireTime * time.Second),
 	}
-	return b.Client.query(req, nil)
+	return b.Client.queryWithRetry(req, nil)
 }
 
 func (b *Bucket) AddBucket(path string) error {
@@ -380,6 +477,11 @@ type Owner struct {
 }
 
 func (b *Bucket) List(prefix, delim, marker string, max int) (result *ListResp, err error) {
+	return b.ListWithContext(context.Background(), prefix, delim, marker, max)
+}
+
+// ListWithContext is like List, the request is cancelled when ctx is done.
+func (b *Bucket) ListWithContext(ctx context.Context, prefix, delim, marker string, max int) (result *ListResp, err error) {
 	params := make(url.Values)
 	params.Set("prefix", prefix)
 	params.Set("delimiter", delim)
@@ -388,17 +490,13 @@ func (b *Bucket) List(prefix, delim, marker string, max int) (result *ListResp,
 		params.Set("max-keys", strconv.FormatInt(int64(max), 10))
 	}
 	result = &ListResp{}
-	for attempt := attempts.Start(); attempt.Next(); {
-		req := &request{
-			bucket: b.Name,
-			params: params,
-			expire: time.Now().Add(DefaultSignExpireTime * time.Second),
-		}
-		err = b.Client.query(req, result)
-		if !shouldRetry(err) {
-			break
-		}
+	req := &request{
+		ctx:    ctx,
+		bucket: b.Name,
+		params: params,
+		expire: time.Now().Add(DefaultSignExpireTime * time.Second),
 	}
+	err = b.Client.queryWithRetry(req, result)
 	if err != nil {
 		return nil, err
 	}
@@ -474,6 +572,8 @@ type Error struct {
 	Resource   string
 	RequestId  string
 	TraceId    string
+	// RetryAfter is the delay requested by the Retry-After header, if any.
+	RetryAfter time.Duration `xml:"-"`
 }
 
 func (e *Error) Error() string {
@@ -481,22 +581,30 @@ func (e *Error) Error() string {
 }
 
 func (client *Client) buildError(r *http.Response) error {
+	// error responses are small, the limit only guards against broken proxies
+	data, readErr := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	io.Copy(ioutil.Discard, r.Body)
+	r.Body.Close()
 	if client.Debug {
 		log.Printf("got error (status code %v)", r.StatusCode)
-		data, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			log.Printf("\tread error: %v", err)
+		if readErr != nil {
+			log.Printf("\tread error: %v", readErr)
 		} else {
 			log.Printf("\tdata:\n%s\n\n", data)
 		}
-		r.Body = ioutil.NopCloser(bytes.NewBuffer(data))
 	}
 
 	err := Error{}
-	// TODO return error if Unmarshal fails?
-	xml.NewDecoder(r.Body).Decode(&err)
-	r.Body.Close()
+	if readErr != nil {
+		err.Message = fmt.Sprintf("%s (cannot read error response: %v)", r.Status, readErr)
+	} else if len(bytes.TrimSpace(data)) > 0 {
+		// the body of HEAD responses and of some errors is empty
+		if decodeErr := xml.Unmarshal(data, &err); decodeErr != nil {
+			err.Message = fmt.Sprintf("%s (cannot decode error response: %v: %q)", r.Status, decodeErr, truncate(data, 200))
+		}
+	}
 	err.StatusCode = r.StatusCode
+	err.RetryAfter = parseRetryAfter(r.Header.Get("Retry-After"))
 	if err.Message == "" {
 		err.Message = r.Status
 	}
@@ -506,54 +614,12 @@ func (client *Client) buildError(r *http.Response) error {
 	return &err
 }
 
-func shouldRetry(err error) bool {
-	if err == nil {
-		return false
+// truncate returns the first n bytes of b at most.
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
 	}
-
-	_, ok := err.(TimeoutError)
-	if ok {
-		return true
-	}
-
-	switch err {
-	case io.ErrUnexpectedEOF, io.EOF:
-		return true
-	}
-	switch e := err.(type) {
-	case *net.DNSError:
-		return true
-	case *net.OpError:
-		switch e.Op {
-		case "read", "write":
-			return true
-		}
-	case *url.Error:
-		// url.Error can be returned either by net/url if a URL cannot be
-		// parsed, or by net/http if the response is closed before the headers
-		// are received or parsed correctly. In that later case, e.Op is set to
-		// the HTTP method name with the first letter uppercased. We don't want
-		// to retry on POST operations, since those are not idempotent, all the
-		// other ones should be safe to retry.
-		switch e.Op {
-		case "Get", "Put", "Delete", "Head":
-			return shouldRetry(e.Err)
-		default:
-			return false
-		}
-	case *Error:
-		switch e.Code {
-		case "InternalError", "NoSuchUpload", "NoSuchBucket", "PathConflict":
-			return true
-		}
-	}
-	return false
-}
-
-var attempts = AttemptStrategy{
-	Min:   5,
-	Total: 5 * time.Second,
-	Delay: 1000 * time.Millisecond,
+	return b
 }
 
 // NewCOSClient creates a new COS.
@@ -580,11 +646,53 @@ func (client *Client) query(req *request, resp interface{}) error {
 	}
 	r, err := client.run(req, resp)
 	if r != nil && r.Body != nil {
+		// drain the body so that the connection can be reused
+		io.Copy(ioutil.Discard, r.Body)
 		r.Body.Close()
 	}
 	return err
 }
 
+// queryWithRetry runs query with the req request until it succeeds or the
+// retry policy of client gives up.
+// A request with a payload is retried only if the payload is an io.Seeker,
+// it is rewound to its initial offset before each attempt.
+func (client *Client) queryWithRetry(req *request, resp interface{}) error {
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	seeker, retryable := req.payload.(io.Seeker)
+	var offset int64
+	if retryable {
+		var err error
+		offset, err = seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	} else {
+		retryable = req.payload == nil
+	}
+	// prepare replaces them with signed copies
+	headers, params := req.headers, req.params
+	attempt := client.retries(ctx)
+	for attempt.Next() {
+		req.headers, req.params = headers, params
+		if seeker != nil {
+			_, err := seeker.Seek(offset, io.SeekStart)
+			if err != nil {
+				return err
+			}
+		}
+		err := client.query(req, resp)
+		if retryable && attempt.Retry(err) {
+			continue
+		}
+		return err
+	}
+	return attempt.Err()
+}
+
 // partiallyEscapedPath partially escapes the COS path allowing for all COS REST API calls.
 //
 // Some commands including:
@@ -659,7 +767,6 @@ func (client *Client) setupHttpRequest(req *request) (*http.Request, error) {
 		Method:     req.method,
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Close:      true,
 		Header:     req.headers,
 		Form:       req.params,
 	}
@@ -678,10 +785,18 @@ func (client *Client) setupHttpRequest(req *request) (*http.Request, error) {
 	return &hreq, nil
 }
 
+// Expired returns whether the credentials of client have expired.
+func (client *Client) Expired() bool {
+	return !client.Expiration.IsZero() && !time.Now().Before(client.Expiration)
+}
+
 func (client *Client) run(req *request, resp interface{}) (*http.Response, error) {
 	if client.Debug {
 		log.Printf("Running COS request: %#v", req)
 	}
+	if client.Expired() {
+		return nil, ErrCredentialsExpired
+	}
 
 	hreq, err := client.setupHttpRequest(req)
 	if err != nil {
@@ -689,32 +804,64 @@ func (client *Client) run(req *request, resp interface{}) (*http.Response, error
 	}
 	hreq.Host = hreq.URL.Host
 	//hreq.RequestURI = "/"
+	if req.ctx != nil {
+		hreq = hreq.WithContext(req.ctx)
+	}
 
 	if client.Debug {
 		log.Printf("http request:%#v, url:%#v", hreq, hreq.URL)
 	}
 
 	c := &http.Client{
-		Transport: &http.Transport{
-			Dial: func(netw, addr string) (c net.Conn, err error) {
-				if client.ConnectTimeout > 0 {
-					c, err = net.DialTimeout(netw, addr, client.ConnectTimeout)
-				} else {
-					c, err = net.Dial(netw, addr)
-				}
-				if err != nil {
-					return
-				}
-				return
-			},
-			Proxy: http.ProxyFromEnvironment,
-		},
-		Timeout: req.timeout,
+		Transport: client.roundTripper(),
+		Timeout:   req.timeout,
 	}
 
 	return client.doHttpRequest(c, hreq, resp)
 }
 
+// roundTripper returns Transport if set, otherwise the shared transport of the client.
+func (client *Client) roundTripper() http.RoundTripper {
+	if client.Transport != nil {
+		return client.Transport
+	}
+	client.transportOnce.Do(func() {
+		client.defaultTransport = client.newTransport()
+	})
+	return client.defaultTransport
+}
+
+// newTransport builds a transport pooling connections, using HTTP/2 when the
+// server supports it.
+func (client *Client) newTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   client.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       client.TLSClientConfig,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          client.MaxIdleConns,
+		MaxIdleConnsPerHost:   client.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       client.MaxConnsPerHost,
+		IdleConnTimeout:       client.IdleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = 100
+	}
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = 16
+	}
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = 90 * time.Second
+	}
+	return t
+}
+
 func copyHeader(header http.Header) (newHeader http.Header) {
 	newHeader = make(http.Header)
 	for k, v := range header {
@@ -802,6 +949,7 @@ func (client *Client) SetEndpoint(endpoint string) {
 }
 
 type request struct {
+	ctx      context.Context
 	method   string
 	bucket   string
 	path     string
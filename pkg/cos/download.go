@@ -0,0 +1,374 @@
+package cos
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// GetRange retrieves length bytes of an object from offset, or all the bytes
+// from offset if length is negative.
+// It is the caller's responsibility to call Close on rc when finished reading.
+func (b *Bucket) GetRange(path string, offset, length int64) (rc io.ReadCloser, err error) {
+	return b.GetRangeWithContext(context.Background(), path, offset, length)
+}
+
+// GetRangeWithContext is like GetRange, the request, including reading the
+// body, is cancelled when ctx is done.
+func (b *Bucket) GetRangeWithContext(ctx context.Context, path string, offset, length int64) (rc io.ReadCloser, err error) {
+	resp, err := b.getRange(ctx, path, offset, length, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// getRange retrieves a range of an object, see GetRange, failing with a
+// precondition error if etag is not empty and the ETag of the object differs.
+func (b *Bucket) getRange(ctx context.Context, path string, offset, length int64, etag string) (*http.Response, error) {
+	headers := make(http.Header)
+	switch {
+	case length == 0:
+		return nil, fmt.Errorf("empty range of %s", path)
+	case length > 0:
+		headers.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		headers.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	if etag != "" {
+		headers.Set("If-Match", etag)
+	}
+	resp, err := b.GetResponseWithContext(ctx, path, headers)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		var start int64
+		cr := resp.Header.Get("Content-Range")
+		if _, err := fmt.Sscanf(cr, "bytes %d-", &start); err != nil || start != offset {
+			resp.Body.Close()
+			return nil, fmt.Errorf("range of %s from %d requested, got %q", path, offset, cr)
+		}
+	case offset > 0:
+		// the range has been ignored, skip the bytes before it
+		_, err = io.CopyN(ioutil.Discard, resp.Body, offset)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// GetResumableReader retrieves an object from a bucket, like GetReader, but
+// if reading the body fails with a retryable error, the rest of the object is
+// requested from the last byte received, according to the retry policy of the
+// client. Reading fails if the object has been replaced in the meantime.
+// It is the caller's responsibility to call Close on rc when finished reading.
+func (b *Bucket) GetResumableReader(path string) (rc io.ReadCloser, err error) {
+	return b.GetResumableReaderWithContext(context.Background(), path)
+}
+
+// GetResumableReaderWithContext is like GetResumableReader, the requests,
+// including reading the body, are cancelled when ctx is done.
+func (b *Bucket) GetResumableReaderWithContext(ctx context.Context, path string) (rc io.ReadCloser, err error) {
+	resp, err := b.GetResponseWithContext(ctx, path, make(http.Header))
+	if err != nil {
+		return nil, err
+	}
+	return &resumableReader{
+		ctx:  ctx,
+		bkt:  b,
+		path: path,
+		etag: resp.Header.Get("ETag"),
+		body: resp.Body,
+	}, nil
+}
+
+// resumableReader reads an object, resuming after the last byte received
+// when reading fails.
+type resumableReader struct {
+	ctx    context.Context
+	bkt    *Bucket
+	path   string
+	etag   string
+	body   io.ReadCloser
+	offset int64
+
+	// attempt counts the resumptions since the last byte received.
+	attempt *retrier
+	// err is the error to recover from at the next Read.
+	err error
+	// failed is the error returned by every Read once reading can't be resumed.
+	failed error
+}
+
+func (r *resumableReader) Read(p []byte) (int, error) {
+	for {
+		if r.failed != nil {
+			return 0, r.failed
+		}
+		if r.err != nil {
+			err := r.resume()
+			if err != nil {
+				r.failed = err
+				return 0, err
+			}
+		}
+		n, err := r.body.Read(p)
+		r.offset += int64(n)
+		if n > 0 {
+			r.attempt = nil
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if !r.resumable(err) {
+			r.failed = err
+			return n, err
+		}
+		r.err = err
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// resumable reports whether reading can be resumed after err.
+func (r *resumableReader) resumable(err error) bool {
+	if r.etag == "" {
+		// a new request could return another version of the object
+		return false
+	}
+	if r.attempt == nil {
+		r.attempt = r.bkt.Client.retries(r.ctx)
+		r.attempt.Next()
+	}
+	return r.attempt.Retry(err)
+}
+
+// resume requests the object from the last byte received.
+func (r *resumableReader) resume() error {
+	err := r.err
+	r.body.Close()
+	r.body = ioutil.NopCloser(eofReader{})
+	if !r.attempt.Next() {
+		if r.attempt.Err() != nil {
+			return r.attempt.Err()
+		}
+		return err
+	}
+	resp, err := r.bkt.getRange(r.ctx, r.path, r.offset, -1, r.etag)
+	if err != nil {
+		return err
+	}
+	r.body = resp.Body
+	r.err = nil
+	return nil
+}
+
+func (r *resumableReader) Close() error {
+	return r.body.Close()
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// DefaultDownloadConcurrency is the number of parts downloaded at once by default.
+const DefaultDownloadConcurrency = 4
+
+// DownloadOptions configure Download.
+type DownloadOptions struct {
+	// PartSize is the size of the ranges requested, DefaultPartSize if zero.
+	PartSize int64
+	// Concurrency is the number of ranges downloaded at once,
+	// DefaultDownloadConcurrency if zero.
+	Concurrency int
+}
+
+func (o *DownloadOptions) setDefaults() {
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultPartSize
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultDownloadConcurrency
+	}
+}
+
+// Download writes an object to w and returns its size. The object is
+// fetched in byte ranges requested concurrently, all of them from the
+// version of the object found at first. Its content is checked against the
+// CRC64 sent by the server or, if there is none, the MD5 or SHA-1 of its
+// ETag, if it is one.
+func (b *Bucket) Download(path string, w io.WriterAt, opts DownloadOptions) (int64, error) {
+	return b.DownloadWithContext(context.Background(), path, w, opts)
+}
+
+// DownloadWithContext is like Download, the requests are cancelled when ctx is done.
+func (b *Bucket) DownloadWithContext(ctx context.Context, path string, w io.WriterAt, opts DownloadOptions) (int64, error) {
+	opts.setDefaults()
+	resp, err := b.HeadWithContext(ctx, path, make(http.Header))
+	if err != nil {
+		return 0, err
+	}
+	size := resp.ContentLength
+	if size < 0 {
+		return 0, fmt.Errorf("unknown size of %s", path)
+	}
+	etag := resp.Header.Get("ETag")
+	sum, expected := downloadChecksum(resp.Header)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	count := int((size + opts.PartSize - 1) / opts.PartSize)
+	// turns[n] is closed once the parts before part n have been checksummed,
+	// so that the checksum is computed in order.
+	turns := make([]chan struct{}, count+1)
+	for n := range turns {
+		turns[n] = make(chan struct{})
+	}
+	close(turns[0])
+	numbers := make(chan int)
+	errs := make(chan error, opts.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 0, opts.PartSize)
+			for n := range numbers {
+				off := int64(n) * opts.PartSize
+				length := opts.PartSize
+				if off+length > size {
+					length = size - off
+				}
+				var err error
+				buf, err = b.getPart(ctx, path, off, buf[:0], length, etag)
+				if err == nil {
+					_, err = w.WriteAt(buf, off)
+				}
+				if err == nil && sum != nil {
+					select {
+					case <-turns[n]:
+						sum.Write(buf)
+					case <-ctx.Done():
+						err = ctx.Err()
+					}
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				close(turns[n+1])
+			}
+		}()
+	}
+
+send:
+	for n := 0; n < count; n++ {
+		select {
+		case numbers <- n:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(numbers)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if sum != nil {
+		if got := expected.format(sum); got != expected.value {
+			return 0, fmt.Errorf("%s checksum mismatch of %s: expected %s, got %s", expected.name, path, expected.value, got)
+		}
+	}
+	return size, nil
+}
+
+// getPart appends the length bytes of an object from offset to buf,
+// requesting the rest of them again after a retryable error.
+func (b *Bucket) getPart(ctx context.Context, path string, offset int64, buf []byte, length int64, etag string) ([]byte, error) {
+	start := len(buf)
+	attempt := b.Client.retries(ctx)
+	for attempt.Next() {
+		read := int64(len(buf) - start)
+		resp, err := b.getRange(ctx, path, offset+read, length-read, etag)
+		if err != nil {
+			return buf, err
+		}
+		w := bytes.NewBuffer(buf)
+		_, err = io.CopyN(w, resp.Body, length-read)
+		resp.Body.Close()
+		buf = w.Bytes()
+		if err == nil {
+			return buf, nil
+		}
+		if int64(len(buf)-start) > read {
+			// some progress has been made, start over the attempts
+			attempt = b.Client.retries(ctx)
+			attempt.Next()
+		}
+		if attempt.Retry(err) {
+			continue
+		}
+		return buf, err
+	}
+	return buf, attempt.Err()
+}
+
+// checksum is the expected checksum of an object.
+type checksum struct {
+	name   string
+	value  string
+	format func(hash.Hash) string
+}
+
+// downloadChecksum returns the hash to compute over an object with the given
+// response headers and the value it must have, or nil if there is none.
+func downloadChecksum(header http.Header) (hash.Hash, checksum) {
+	if v := header.Get("x-cos-hash-crc64ecma"); v != "" {
+		return crc64.New(crc64.MakeTable(crc64.ECMA)), checksum{
+			name:  "CRC64",
+			value: v,
+			format: func(h hash.Hash) string {
+				return strconv.FormatUint(h.(hash.Hash64).Sum64(), 10)
+			},
+		}
+	}
+	hexsum := func(h hash.Hash) string {
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	etag := strings.ToLower(strings.Trim(header.Get("ETag"), `"`))
+	if _, err := hex.DecodeString(etag); err != nil {
+		// the ETag of a multipart upload is not a digest of the content
+		return nil, checksum{}
+	}
+	switch len(etag) {
+	case 2 * md5.Size:
+		return md5.New(), checksum{name: "MD5", value: etag, format: hexsum}
+	case 2 * sha1.Size:
+		return sha1.New(), checksum{name: "SHA-1", value: etag, format: hexsum}
+	}
+	return nil, checksum{}
+}
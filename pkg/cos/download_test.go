@@ -0,0 +1,187 @@
+package cos
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memWriterAt is an io.WriterAt writing in a slice of a fixed size.
+type memWriterAt []byte
+
+func (m memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m)) {
+		return 0, fmt.Errorf("write of %d bytes at %d past %d", len(p), off, len(m))
+	}
+	return copy(m[off:], p), nil
+}
+
+// rangeStart returns the first byte requested by r, -1 if it has no range.
+func rangeStart(r *http.Request) int {
+	var start int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+		return -1
+	}
+	return start
+}
+
+const downloadPartSize = 64 << 10
+
+// download downloads key with small parts, the first ones answered last so
+// that they are received out of order.
+func download(t *testing.T, f *fakeCOS, key string) ([]byte, error) {
+	f.delay = func(r *http.Request) time.Duration {
+		if start := rangeStart(r); start >= 0 {
+			return time.Duration(16-start/downloadPartSize) * time.Millisecond
+		}
+		return 0
+	}
+	bkt, stop := f.start()
+	defer stop()
+
+	w := make(memWriterAt, len(f.objects[key]))
+	size, err := bkt.Download(key, w, DownloadOptions{PartSize: downloadPartSize, Concurrency: 4})
+	if err == nil && size != int64(len(w)) {
+		t.Errorf("downloaded %d bytes, expected %d", size, len(w))
+	}
+	return w, err
+}
+
+func TestDownloadChecksumInOrder(t *testing.T) {
+	data := fakeData(10*downloadPartSize + 100)
+	for name, header := range map[string]http.Header{
+		"CRC64": nil,
+		"MD5":   {"X-Cos-Hash-Crc64ecma": nil},
+	} {
+		f := newFakeCOS()
+		f.objects["/chart.tgz"] = data
+		f.header["/chart.tgz"] = header
+		got, err := download(t, f, "/chart.tgz")
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: downloaded object differs", name)
+		}
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	for name, header := range map[string]http.Header{
+		"CRC64": {"X-Cos-Hash-Crc64ecma": {"1"}},
+		"MD5":   {"X-Cos-Hash-Crc64ecma": nil, "Etag": {`"0123456789abcdef0123456789abcdef"`}},
+	} {
+		f := newFakeCOS()
+		f.objects["/chart.tgz"] = fakeData(3*downloadPartSize + 100)
+		f.header["/chart.tgz"] = header
+		_, err := download(t, f, "/chart.tgz")
+		if err == nil || !strings.Contains(err.Error(), name+" checksum mismatch") {
+			t.Errorf("%s: expected a checksum mismatch, got %v", name, err)
+		}
+	}
+}
+
+func TestDownloadResumesParts(t *testing.T) {
+	data := fakeData(4*downloadPartSize + 100)
+	f := newFakeCOS()
+	f.objects["/chart.tgz"] = data
+	cut := make(map[int]bool)
+	f.cut = func(r *http.Request) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		start := rangeStart(r)
+		if start%downloadPartSize != 0 || cut[start] {
+			return -1
+		}
+		// the first request of each part stops in the middle
+		cut[start] = true
+		return 1000
+	}
+	got, err := download(t, f, "/chart.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("downloaded object differs")
+	}
+}
+
+func TestResumableReader(t *testing.T) {
+	data := fakeData(300 << 10)
+	f := newFakeCOS()
+	f.objects["/chart.tgz"] = data
+	cuts := []int{100 << 10, 100}
+	f.cut = func(r *http.Request) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if len(cuts) == 0 {
+			return -1
+		}
+		n := cuts[0]
+		cuts = cuts[1:]
+		return n
+	}
+	bkt, stop := f.start()
+	defer stop()
+
+	rc, err := bkt.GetResumableReader("/chart.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("read object differs")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) != 3 {
+		t.Fatalf("%d requests, expected 3", len(f.requests))
+	}
+	for i, start := range []int{100 << 10, 100<<10 + 100} {
+		r := f.requests[i+1]
+		if rangeStart(r) != start || r.Header.Get("If-Match") != fakeETag(data) {
+			t.Errorf("request %d: Range %q If-Match %q", i+1, r.Header.Get("Range"), r.Header.Get("If-Match"))
+		}
+	}
+}
+
+func TestResumableReaderObjectChanged(t *testing.T) {
+	data := fakeData(300 << 10)
+	f := newFakeCOS()
+	f.objects["/chart.tgz"] = data
+	f.cut = func(r *http.Request) int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if rangeStart(r) >= 0 {
+			return -1
+		}
+		// the object is replaced while it is read
+		f.objects["/chart.tgz"] = fakeData(200 << 10)
+		return 100 << 10
+	}
+	bkt, stop := f.start()
+	defer stop()
+
+	rc, err := bkt.GetResumableReader("/chart.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	_, err = ioutil.ReadAll(rc)
+	if !IsPreconditionFailed(err) {
+		t.Fatalf("expected a precondition error, got %v", err)
+	}
+	if _, err := rc.Read(make([]byte, 1)); !IsPreconditionFailed(err) {
+		t.Errorf("expected the error again, got %v", err)
+	}
+}
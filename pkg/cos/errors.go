@@ -0,0 +1,76 @@
+package cos
+
+import (
+	"net/http"
+)
+
+// AsError returns the *Error at the origin of err, following the errors
+// wrapping it with a Cause or Unwrap method, or nil if there is none.
+func AsError(err error) *Error {
+	for err != nil {
+		if e, ok := err.(*Error); ok {
+			return e
+		}
+		switch w := err.(type) {
+		case interface{ Cause() error }:
+			err = w.Cause()
+		case interface{ Unwrap() error }:
+			err = w.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// IsNotFound reports whether err is caused by a missing object, bucket or upload.
+func IsNotFound(err error) bool {
+	e := AsError(err)
+	return e != nil && e.StatusCode == http.StatusNotFound
+}
+
+// IsAccessDenied reports whether err is caused by credentials that are
+// invalid or not allowed to perform the request.
+func IsAccessDenied(err error) bool {
+	e := AsError(err)
+	if e == nil {
+		return false
+	}
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	switch e.Code {
+	case "AccessDenied", "InvalidAccessKeyId", "SignatureDoesNotMatch":
+		return true
+	}
+	return false
+}
+
+// IsPreconditionFailed reports whether err is caused by a conditional request,
+// e.g. with If-Match, whose condition is not met.
+func IsPreconditionFailed(err error) bool {
+	e := AsError(err)
+	return e != nil && e.StatusCode == http.StatusPreconditionFailed
+}
+
+// IsConflict reports whether err is caused by a request conflicting with the
+// state of the object, e.g. a write with x-cos-forbid-overwrite on an existing one.
+func IsConflict(err error) bool {
+	e := AsError(err)
+	return e != nil && e.StatusCode == http.StatusConflict
+}
+
+// IsThrottled reports whether err is caused by a request rejected because of
+// the request rate.
+func IsThrottled(err error) bool {
+	e := AsError(err)
+	return e != nil && (e.StatusCode == http.StatusTooManyRequests || throttlingCodes[e.Code])
+}
+
+// IsNotModified reports whether err is the response to a conditional request,
+// e.g. with If-None-Match, whose object has not changed.
+func IsNotModified(err error) bool {
+	e := AsError(err)
+	return e != nil && e.StatusCode == http.StatusNotModified
+}
@@ -2,6 +2,7 @@ package cos
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/base64"
@@ -28,6 +29,8 @@ type Multi struct {
 	Bucket   *Bucket
 	Key      string
 	UploadID string `xml:"UploadId"`
+	// Initiated is the time the upload was initiated at, as returned by ListMulti.
+	Initiated string
 }
 
 // That's the default. Here just for testing.
@@ -53,14 +56,21 @@ type listMultiResp struct {
 // into different groupings of keys, similar to how folders would work.
 //
 func (b *Bucket) ListMulti(prefix, delim string) (multis []*Multi, prefixes []string, err error) {
+	return b.ListMultiWithContext(context.Background(), prefix, delim)
+}
+
+// ListMultiWithContext is like ListMulti, the requests are cancelled when ctx is done.
+func (b *Bucket) ListMultiWithContext(ctx context.Context, prefix, delim string) (multis []*Multi, prefixes []string, err error) {
 	params := make(url.Values)
 	params.Set("uploads", "")
 	//params.Set("max-uploads", strconv.FormatInt(int64(listMultiMax), 10))
 	params.Set("prefix", prefix)
 	params.Set("delimiter", delim)
 
-	for attempt := attempts.Start(); attempt.Next(); {
+	attempt := b.Client.retries(ctx)
+	for attempt.Next() {
 		req := &request{
+			ctx:    ctx,
 			method: "GET",
 			bucket: b.Name,
 			params: params,
@@ -68,7 +78,7 @@ func (b *Bucket) ListMulti(prefix, delim string) (multis []*Multi, prefixes []st
 		}
 		var resp listMultiResp
 		err := b.Client.query(req, &resp)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		if err != nil {
@@ -85,21 +95,26 @@ func (b *Bucket) ListMulti(prefix, delim string) (multis []*Multi, prefixes []st
 		}
 		params.Set("key-marker", resp.NextKeyMarker)
 		params.Set("upload-id-marker", resp.NextUploadIdMarker)
-		attempt = attempts.Start() // Last request worked.
+		attempt = b.Client.retries(ctx) // Last request worked.
 	}
-	panic("unreachable")
+	return nil, nil, attempt.Err()
 }
 
 func hasCode(err error, code string) bool {
-	e, ok := err.(*Error)
-	return ok && e.Code == code
+	e := AsError(err)
+	return e != nil && e.Code == code
 }
 
 // Multi returns a multipart upload handler for the provided key
 // inside b. If a multipart upload exists for key, it is returned,
 // otherwise a new multipart upload is initiated with contType and perm.
 func (b *Bucket) Multi(key, contType string, perm ACL, options Options) (*Multi, error) {
-	multis, _, err := b.ListMulti(key, "")
+	return b.MultiWithContext(context.Background(), key, contType, perm, options)
+}
+
+// MultiWithContext is like Multi, the requests are cancelled when ctx is done.
+func (b *Bucket) MultiWithContext(ctx context.Context, key, contType string, perm ACL, options Options) (*Multi, error) {
+	multis, _, err := b.ListMultiWithContext(ctx, key, "")
 	if err != nil && !hasCode(err, "NoSuchUpload") {
 		return nil, err
 	}
@@ -108,7 +123,7 @@ func (b *Bucket) Multi(key, contType string, perm ACL, options Options) (*Multi,
 			return m, nil
 		}
 	}
-	return b.InitMulti(key, contType, perm, options)
+	return b.InitMultiWithContext(ctx, key, contType, perm, options)
 }
 
 // InitMulti initializes a new multipart upload at the provided
@@ -117,6 +132,11 @@ func (b *Bucket) Multi(key, contType string, perm ACL, options Options) (*Multi,
 //
 //
 func (b *Bucket) InitMulti(key string, contType string, perm ACL, options Options) (*Multi, error) {
+	return b.InitMultiWithContext(context.Background(), key, contType, perm, options)
+}
+
+// InitMultiWithContext is like InitMulti, the request is cancelled when ctx is done.
+func (b *Bucket) InitMultiWithContext(ctx context.Context, key string, contType string, perm ACL, options Options) (*Multi, error) {
 	headers := make(http.Header)
 	headers.Set("Content-Length", "0")
 	headers.Set("Content-Type", contType)
@@ -126,6 +146,7 @@ func (b *Bucket) InitMulti(key string, contType string, perm ACL, options Option
 	params := make(url.Values)
 	params.Set("uploads", "")
 	req := &request{
+		ctx:     ctx,
 		method:  "POST",
 		bucket:  b.Name,
 		path:    key,
@@ -133,16 +154,10 @@ func (b *Bucket) InitMulti(key string, contType string, perm ACL, options Option
 		params:  params,
 		expire:  time.Now().Add(DefaultSignExpireTime * time.Second),
 	}
-	var err error
 	var resp struct {
 		UploadId string `xml:"UploadId"`
 	}
-	for attempt := attempts.Start(); attempt.Next(); {
-		err = b.Client.query(req, &resp)
-		if !shouldRetry(err) {
-			break
-		}
-	}
+	err := b.Client.queryWithRetry(req, &resp)
 	if err != nil {
 		return nil, err
 	}
@@ -162,6 +177,12 @@ func (m *Multi) PutPartCopy(n int, options CopyOptions, source string) (*CopyObj
 //
 //
 func (m *Multi) PutPartCopyWithContentLength(n int, options CopyOptions, source string, contentLength int64) (*CopyObjectResult, Part, error) {
+	return m.PutPartCopyWithContext(context.Background(), n, options, source, contentLength)
+}
+
+// PutPartCopyWithContext is like PutPartCopyWithContentLength, the requests
+// are cancelled when ctx is done.
+func (m *Multi) PutPartCopyWithContext(ctx context.Context, n int, options CopyOptions, source string, contentLength int64) (*CopyObjectResult, Part, error) {
 	// TODO source format a /BUCKET/PATH/TO/OBJECT
 	// TODO not a good design. API could be changed to PutPartCopyWithinBucket(..., path) and PutPartCopyFromBucket(bucket, path)
 
@@ -179,15 +200,17 @@ func (m *Multi) PutPartCopyWithContentLength(n int, options CopyOptions, source
 		//log.Println("sourceBucket: ", sourceBucket.Name)
 		//log.Println("HEAD: ", strings.strings.SplitAfterN(source, "/", 3)[2])
 		// TODO SplitAfterN can be use in bucket name
-		sourceMeta, err := sourceBucket.Head(strings.SplitAfterN(source, "/", 3)[2], nil)
+		sourceMeta, err := sourceBucket.HeadWithContext(ctx, strings.SplitAfterN(source, "/", 3)[2], nil)
 		if err != nil {
 			return nil, Part{}, err
 		}
 		contentLength = sourceMeta.ContentLength
 	}
 
-	for attempt := attempts.Start(); attempt.Next(); {
+	attempt := m.Bucket.Client.retries(ctx)
+	for attempt.Next() {
 		req := &request{
+			ctx:     ctx,
 			method:  "PUT",
 			bucket:  m.Bucket.Name,
 			path:    m.Key,
@@ -197,7 +220,7 @@ func (m *Multi) PutPartCopyWithContentLength(n int, options CopyOptions, source
 		}
 		resp := &CopyObjectResult{}
 		err := m.Bucket.Client.query(req, resp)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		if err != nil {
@@ -208,7 +231,7 @@ func (m *Multi) PutPartCopyWithContentLength(n int, options CopyOptions, source
 		}
 		return resp, Part{n, resp.ETag, contentLength}, nil
 	}
-	panic("unreachable")
+	return nil, Part{}, attempt.Err()
 }
 
 // PutPart sends part n of the multipart upload, reading all the content from r.
@@ -221,7 +244,16 @@ func (m *Multi) PutPart(n int, r io.ReadSeeker) (Part, error) {
 	if err != nil {
 		return Part{}, err
 	}
-	return m.putPart(n, r, partSize, hexsha1, 0)
+	return m.putPart(context.Background(), n, r, partSize, hexsha1, 0)
+}
+
+// PutPartWithContext is like PutPart, the request is cancelled when ctx is done.
+func (m *Multi) PutPartWithContext(ctx context.Context, n int, r io.ReadSeeker) (Part, error) {
+	partSize, _, hexsha1, err := seekerInfo(r)
+	if err != nil {
+		return Part{}, err
+	}
+	return m.putPart(ctx, n, r, partSize, hexsha1, 0)
 }
 
 func (m *Multi) PutPartWithTimeout(n int, r io.ReadSeeker, timeout time.Duration) (Part, error) {
@@ -229,10 +261,10 @@ func (m *Multi) PutPartWithTimeout(n int, r io.ReadSeeker, timeout time.Duration
 	if err != nil {
 		return Part{}, err
 	}
-	return m.putPart(n, r, partSize, hexsha1, timeout)
+	return m.putPart(context.Background(), n, r, partSize, hexsha1, timeout)
 }
 
-func (m *Multi) putPart(n int, r io.ReadSeeker, partSize int64, hexsha1 string, timeout time.Duration) (Part, error) {
+func (m *Multi) putPart(ctx context.Context, n int, r io.ReadSeeker, partSize int64, hexsha1 string, timeout time.Duration) (Part, error) {
 	headers := make(http.Header)
 	headers.Set("Content-Length", strconv.FormatInt(partSize, 10))
 	headers.Set("x-cos-content-sha1", hexsha1)
@@ -241,12 +273,14 @@ func (m *Multi) putPart(n int, r io.ReadSeeker, partSize int64, hexsha1 string,
 	params.Set("uploadId", m.UploadID)
 	params.Set("partNumber", strconv.FormatInt(int64(n), 10))
 
-	for attempt := attempts.Start(); attempt.Next(); {
+	attempt := m.Bucket.Client.retries(ctx)
+	for attempt.Next() {
 		_, err := r.Seek(0, 0)
 		if err != nil {
 			return Part{}, err
 		}
 		req := &request{
+			ctx:     ctx,
 			method:  "PUT",
 			bucket:  m.Bucket.Name,
 			path:    m.Key,
@@ -261,7 +295,7 @@ func (m *Multi) putPart(n int, r io.ReadSeeker, partSize int64, hexsha1 string,
 			return Part{}, err
 		}
 		resp, err := m.Bucket.Client.run(req, nil)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		if err != nil {
@@ -273,7 +307,7 @@ func (m *Multi) putPart(n int, r io.ReadSeeker, partSize int64, hexsha1 string,
 		}
 		return Part{n, etag, partSize}, nil
 	}
-	panic("unreachable")
+	return Part{}, attempt.Err()
 }
 
 func seekerInfo(r io.ReadSeeker) (size int64, sha1b64 string, sha1hex string, err error) {
@@ -340,6 +374,11 @@ func (m *Multi) ListParts() ([]Part, error) {
 // returned.
 //
 func (m *Multi) ListPartsFull(partNumberMarker int, maxParts int) ([]Part, error) {
+	return m.ListPartsWithContext(context.Background(), partNumberMarker, maxParts)
+}
+
+// ListPartsWithContext is like ListPartsFull, the requests are cancelled when ctx is done.
+func (m *Multi) ListPartsWithContext(ctx context.Context, partNumberMarker int, maxParts int) ([]Part, error) {
 	if maxParts > listPartsMax {
 		maxParts = listPartsMax
 	}
@@ -350,8 +389,10 @@ func (m *Multi) ListPartsFull(partNumberMarker int, maxParts int) ([]Part, error
 	params.Set("part-number-marker", strconv.FormatInt(int64(partNumberMarker), 10))
 
 	var parts partSlice
-	for attempt := attempts.Start(); attempt.Next(); {
+	attempt := m.Bucket.Client.retries(ctx)
+	for attempt.Next() {
 		req := &request{
+			ctx:    ctx,
 			method: "GET",
 			bucket: m.Bucket.Name,
 			path:   m.Key,
@@ -360,7 +401,7 @@ func (m *Multi) ListPartsFull(partNumberMarker int, maxParts int) ([]Part, error
 		}
 		var resp listPartsResp
 		err := m.Bucket.Client.query(req, &resp)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		if err != nil {
@@ -372,9 +413,9 @@ func (m *Multi) ListPartsFull(partNumberMarker int, maxParts int) ([]Part, error
 			return parts, nil
 		}
 		params.Set("part-number-marker", resp.NextPartNumberMarker)
-		attempt = attempts.Start() // Last request worked.
+		attempt = m.Bucket.Client.retries(ctx) // Last request worked.
 	}
-	panic("unreachable")
+	return nil, attempt.Err()
 }
 
 type ReaderAtSeeker interface {
@@ -402,6 +443,11 @@ func (p completeParts) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 // final object. This operation may take several minutes.
 //
 func (m *Multi) Complete(parts []Part) error {
+	return m.CompleteWithContext(context.Background(), parts)
+}
+
+// CompleteWithContext is like Complete, the request is cancelled when ctx is done.
+func (m *Multi) CompleteWithContext(ctx context.Context, parts []Part) error {
 	params := make(url.Values)
 	params.Set("uploadId", m.UploadID)
 
@@ -423,23 +469,17 @@ func (m *Multi) Complete(parts []Part) error {
 	headers := make(http.Header)
 	headers.Set("Content-Length", strconv.FormatInt(int64(len(data)), 10))
 
-	for attempt := attempts.Start(); attempt.Next(); {
-		req := &request{
-			method:  "POST",
-			bucket:  m.Bucket.Name,
-			path:    m.Key,
-			headers: headers,
-			params:  params,
-			payload: payload,
-			expire:  time.Now().Add(DefaultSignExpireTime * time.Second),
-		}
-		err := m.Bucket.Client.query(req, nil)
-		if shouldRetry(err) && attempt.HasNext() {
-			continue
-		}
-		return err
+	req := &request{
+		ctx:     ctx,
+		method:  "POST",
+		bucket:  m.Bucket.Name,
+		path:    m.Key,
+		headers: headers,
+		params:  params,
+		payload: payload,
+		expire:  time.Now().Add(DefaultSignExpireTime * time.Second),
 	}
-	panic("unreachable")
+	return m.Bucket.Client.queryWithRetry(req, nil)
 }
 
 // Abort deletes an unifinished multipart upload and any previously
@@ -459,11 +499,18 @@ func (m *Multi) Complete(parts []Part) error {
 //
 
 func (m *Multi) Abort() error {
+	return m.AbortWithContext(context.Background())
+}
+
+// AbortWithContext is like Abort, the request is cancelled when ctx is done.
+func (m *Multi) AbortWithContext(ctx context.Context) error {
 	params := make(url.Values)
 	params.Set("uploadId", m.UploadID)
 
-	for attempt := attempts.Start(); attempt.Next(); {
+	attempt := m.Bucket.Client.retries(ctx)
+	for attempt.Next() {
 		req := &request{
+			ctx:    ctx,
 			method: "DELETE",
 			bucket: m.Bucket.Name,
 			path:   m.Key,
@@ -471,10 +518,10 @@ func (m *Multi) Abort() error {
 			expire: time.Now().Add(DefaultSignExpireTime * time.Second),
 		}
 		err := m.Bucket.Client.query(req, nil)
-		if shouldRetry(err) && attempt.HasNext() {
+		if attempt.Retry(err) {
 			continue
 		}
 		return err
 	}
-	panic("unreachable")
+	return attempt.Err()
 }
@@ -0,0 +1,159 @@
+package cos
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/imroc/helm-cos/pkg/cos/util"
+)
+
+// uploadState is the progress of a resumable upload, saved in UploadOptions.StateFile.
+type uploadState struct {
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+	// Parts are the parts sent, by number.
+	Parts map[int]statePart `json:"parts"`
+}
+
+type statePart struct {
+	SHA1 string `json:"sha1"`
+	ETag string `json:"etag"`
+	Size int64  `json:"size"`
+}
+
+// loadUploadState reads the state saved in filename, nil if there is none.
+func loadUploadState(filename string) (*uploadState, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &uploadState{}
+	if err := json.Unmarshal(b, st); err != nil {
+		// a state that can't be read only means the upload can't be resumed
+		return nil, nil
+	}
+	if st.Parts == nil {
+		st.Parts = make(map[int]statePart)
+	}
+	return st, nil
+}
+
+// save writes st to filename, replacing it atomically.
+func (st *uploadState) save(filename string) error {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filename, b, 0600)
+}
+
+// uploadResumable uploads r in parts, resuming the upload saved in
+// opts.StateFile if it is for the same key and size.
+func (b *Bucket) uploadResumable(ctx context.Context, key string, r io.ReaderAt, size int64, opts UploadOptions) error {
+	st, err := loadUploadState(opts.StateFile)
+	if err != nil {
+		return err
+	}
+	var m *Multi
+	done := make(map[int]Part)
+	if st != nil && st.Key == key && st.Size == size && st.PartSize >= MinPartSize {
+		m = &Multi{Bucket: b, Key: key, UploadID: st.UploadID}
+		done, err = m.reconcile(ctx, r, st)
+		if IsNotFound(err) {
+			// the upload has been completed or aborted
+			m, done = nil, make(map[int]Part)
+		} else if err != nil {
+			return err
+		}
+	} else if st != nil {
+		// the upload of something else, which won't be resumed
+		stale := &Multi{Bucket: b, Key: st.Key, UploadID: st.UploadID}
+		stale.AbortWithContext(ctx)
+	}
+	if m == nil {
+		m, err = b.InitMultiWithContext(ctx, key, opts.ContentType, opts.ACL, opts.Options)
+		if err != nil {
+			return err
+		}
+		st = &uploadState{
+			Key:      key,
+			UploadID: m.UploadID,
+			Size:     size,
+			PartSize: opts.PartSize,
+			Parts:    make(map[int]statePart),
+		}
+		if err := st.save(opts.StateFile); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	parts, err := m.putParts(ctx, r, size, st.PartSize, opts.Concurrency, done, func(p Part, sha1 string) {
+		mu.Lock()
+		defer mu.Unlock()
+		st.Parts[p.N] = statePart{SHA1: sha1, ETag: p.ETag, Size: p.Size}
+		// if it can't be saved, the part will just be sent again on resume
+		st.save(opts.StateFile)
+	})
+	if err != nil {
+		return err
+	}
+	err = m.CompleteWithContext(ctx, parts)
+	if err != nil {
+		return err
+	}
+	return os.Remove(opts.StateFile)
+}
+
+// reconcile returns the parts of the upload already sent with the same
+// content as r, according to ListParts. A part is kept if its ETag is the one
+// saved in st and the content still has the saved SHA-1, or if its ETag is
+// the SHA-1 or MD5 of the content. The parts of st are updated accordingly.
+func (m *Multi) reconcile(ctx context.Context, r io.ReaderAt, st *uploadState) (map[int]Part, error) {
+	remote, err := m.ListPartsWithContext(ctx, 0, listPartsMax)
+	if err != nil {
+		return nil, err
+	}
+	done := make(map[int]Part)
+	parts := make(map[int]statePart)
+	for _, p := range remote {
+		off := int64(p.N-1) * st.PartSize
+		length := st.PartSize
+		if off+length > st.Size {
+			length = st.Size - off
+		}
+		if p.N < 1 || length < 0 || p.Size != length {
+			continue
+		}
+		section := io.NewSectionReader(r, off, length)
+		_, _, sha1hex, err := seekerInfo(section)
+		if err != nil {
+			return nil, err
+		}
+		etag := strings.Trim(p.ETag, `"`)
+		saved, ok := st.Parts[p.N]
+		if !(ok && saved.SHA1 == sha1hex && strings.Trim(saved.ETag, `"`) == etag) && etag != sha1hex {
+			_, md5hex, _, err := seekerInfoMD5(section)
+			if err != nil {
+				return nil, err
+			}
+			if etag != md5hex {
+				continue
+			}
+		}
+		done[p.N] = p
+		parts[p.N] = statePart{SHA1: sha1hex, ETag: p.ETag, Size: p.Size}
+	}
+	st.Parts = parts
+	return done, nil
+}
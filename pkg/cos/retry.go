@@ -0,0 +1,210 @@
+package cos
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether and when failed requests are retried.
+//
+// The delay before the n-th retry is BaseDelay * 2^(n-1), capped to MaxDelay,
+// of which a random part up to a half is removed to spread the retries of
+// concurrent clients. If the server sends a Retry-After header, its delay is
+// used instead.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry.
+	BaseDelay time.Duration
+	// MaxDelay is the maximum delay between two attempts.
+	MaxDelay time.Duration
+	// MaxElapsed is the time after the first attempt past which no retry is
+	// made. Zero means no limit.
+	MaxElapsed time.Duration
+	// Retryable reports whether a request failing with err can be retried.
+	// If nil, IsRetryable is used.
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy is the retry policy of clients without one.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+	MaxElapsed:  time.Minute,
+}
+
+// throttlingCodes are the error codes of requests rejected because of their rate.
+var throttlingCodes = map[string]bool{
+	"SlowDown":             true,
+	"Throttling":           true,
+	"TooManyRequests":      true,
+	"RequestLimitExceeded": true,
+}
+
+// IsRetryable reports whether a request failing with err can be retried:
+// network errors, server errors (HTTP 500, 502, 503 and 504) and throttling.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	switch err {
+	case io.ErrUnexpectedEOF, io.EOF:
+		return true
+	}
+	switch e := err.(type) {
+	case *net.DNSError:
+		return true
+	case *net.OpError:
+		switch e.Op {
+		case "read", "write":
+			return true
+		}
+	case *url.Error:
+		// url.Error can be returned either by net/url if a URL cannot be
+		// parsed, or by net/http if the response is closed before the headers
+		// are received or parsed correctly. In that later case, e.Op is set to
+		// the HTTP method name with the first letter uppercased. We don't want
+		// to retry on POST operations, since those are not idempotent, all the
+		// other ones should be safe to retry.
+		switch e.Op {
+		case "Get", "Put", "Delete", "Head":
+			return IsRetryable(e.Err)
+		default:
+			return false
+		}
+	case *Error:
+		switch e.StatusCode {
+		case http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+			http.StatusTooManyRequests:
+			return true
+		}
+		if throttlingCodes[e.Code] {
+			return true
+		}
+		if e.Code == "InternalError" {
+			return true
+		}
+	}
+	if t, ok := err.(TimeoutError); ok && t.Timeout() {
+		return true
+	}
+	return false
+}
+
+// retries starts the attempts of a request with the retry policy of client.
+func (client *Client) retries(ctx context.Context) *retrier {
+	p := DefaultRetryPolicy
+	if client.RetryPolicy != nil {
+		p = *client.RetryPolicy
+	}
+	if p.Retryable == nil {
+		p.Retryable = IsRetryable
+	}
+	return &retrier{
+		policy: p,
+		ctx:    ctx,
+		start:  time.Now(),
+	}
+}
+
+// retrier runs the attempts of a request:
+//
+//	attempt := client.retries(ctx)
+//	for attempt.Next() {
+//		err := ...
+//		if attempt.Retry(err) {
+//			continue
+//		}
+//		return err
+//	}
+//	return attempt.Err()
+type retrier struct {
+	policy RetryPolicy
+	ctx    context.Context
+	start  time.Time
+	count  int
+	delay  time.Duration
+}
+
+// Next waits until it is time to perform the next attempt or returns
+// false if ctx is done.
+func (r *retrier) Next() bool {
+	if r.ctx.Err() != nil {
+		return false
+	}
+	if r.count > 0 && r.delay > 0 {
+		t := time.NewTimer(r.delay)
+		select {
+		case <-t.C:
+		case <-r.ctx.Done():
+			t.Stop()
+			return false
+		}
+	}
+	r.count++
+	return true
+}
+
+// Retry reports whether another attempt will be made after one failing with err.
+func (r *retrier) Retry(err error) bool {
+	if err == nil || r.ctx.Err() != nil || !r.policy.Retryable(err) {
+		return false
+	}
+	if r.policy.MaxAttempts > 0 && r.count >= r.policy.MaxAttempts {
+		return false
+	}
+	r.delay = r.backoff(err)
+	if r.policy.MaxElapsed > 0 && time.Since(r.start)+r.delay > r.policy.MaxElapsed {
+		return false
+	}
+	return true
+}
+
+// Err returns the error of the context of the attempts once it is done, nil otherwise.
+func (r *retrier) Err() error {
+	return r.ctx.Err()
+}
+
+// backoff returns the delay before the next attempt.
+func (r *retrier) backoff(err error) time.Duration {
+	if e, ok := err.(*Error); ok && e.RetryAfter > 0 {
+		return e.RetryAfter
+	}
+	d := r.policy.BaseDelay
+	for i := 1; i < r.count && (r.policy.MaxDelay <= 0 || d < r.policy.MaxDelay); i++ {
+		d *= 2
+	}
+	if r.policy.MaxDelay > 0 && d > r.policy.MaxDelay {
+		d = r.policy.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d - time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given in seconds
+// or as an HTTP date, or zero if it is not set or invalid.
+func parseRetryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(h); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
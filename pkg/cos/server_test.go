@@ -0,0 +1,307 @@
+package cos
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeCOS is an in-memory COS bucket serving the requests of the client
+// used by these tests: objects and multipart uploads.
+type fakeCOS struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	// header overrides the headers sent with an object, by key.
+	header  map[string]http.Header
+	uploads map[string]*fakeUpload
+	nextID  int
+
+	// failPart, if set, makes the part uploads for which it returns true fail
+	// with a non retryable error.
+	failPart func(n int) bool
+	// cut, if set, returns the number of bytes after which the connection
+	// is closed while sending an object, or a negative number to send it all.
+	cut func(r *http.Request) int
+	// delay, if set, returns how long to wait before answering a request.
+	delay func(r *http.Request) time.Duration
+
+	// sent counts the uploads of each part number.
+	sent     map[int]int
+	aborted  []string
+	requests []*http.Request
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+func newFakeCOS() *fakeCOS {
+	return &fakeCOS{
+		objects: make(map[string][]byte),
+		header:  make(map[string]http.Header),
+		uploads: make(map[string]*fakeUpload),
+		sent:    make(map[int]int),
+	}
+}
+
+// start serves f and returns a bucket using it, with short retry delays.
+func (f *fakeCOS) start() (*Bucket, func()) {
+	srv := httptest.NewServer(f)
+	client := &Client{RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+	client.SetEndpoint(strings.TrimPrefix(srv.URL, "http://"))
+	return client.Bucket(""), srv.Close
+}
+
+func fakeETag(b []byte) string {
+	sum := md5.Sum(b)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeCOS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	delay := f.delay
+	f.mu.Unlock()
+	if delay != nil {
+		time.Sleep(delay(r))
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	q := r.URL.Query()
+	key := r.URL.Path
+	_, uploads := q["uploads"]
+	id := q.Get("uploadId")
+	switch {
+	case r.Method == "POST" && uploads:
+		f.initMulti(w, key)
+	case r.Method == "PUT" && id != "":
+		f.putPart(w, id, q.Get("partNumber"), body)
+	case r.Method == "GET" && id != "":
+		f.listParts(w, id, q.Get("part-number-marker"), q.Get("max-parts"))
+	case r.Method == "POST" && id != "":
+		f.complete(w, id, body)
+	case r.Method == "DELETE" && id != "":
+		f.abort(w, id)
+	case r.Method == "PUT":
+		f.mu.Lock()
+		f.objects[key] = body
+		f.mu.Unlock()
+		w.Header().Set("ETag", fakeETag(body))
+	case r.Method == "GET" || r.Method == "HEAD":
+		f.getObject(w, r, key)
+	default:
+		fakeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeCOS) initMulti(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	f.nextID++
+	id := strconv.Itoa(f.nextID)
+	f.uploads[id] = &fakeUpload{key: key, parts: make(map[int][]byte)}
+	f.mu.Unlock()
+	fmt.Fprintf(w, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+}
+
+func (f *fakeCOS) putPart(w http.ResponseWriter, id, number string, body []byte) {
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 {
+		fakeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	if f.failPart != nil && f.failPart(n) {
+		fakeError(w, http.StatusBadRequest, "InvalidPart")
+		return
+	}
+	f.sent[n]++
+	u.parts[n] = body
+	w.Header().Set("ETag", fakeETag(body))
+}
+
+func (f *fakeCOS) listParts(w http.ResponseWriter, id, marker, max string) {
+	from, _ := strconv.Atoi(marker)
+	limit, err := strconv.Atoi(max)
+	if err != nil || limit < 1 {
+		limit = 1000
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	numbers := []int{}
+	for n := range u.parts {
+		if n > from {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	resp := listPartsResp{}
+	if len(numbers) > limit {
+		numbers = numbers[:limit]
+		resp.IsTruncated = true
+		resp.NextPartNumberMarker = strconv.Itoa(numbers[limit-1])
+	}
+	for _, n := range numbers {
+		resp.Part = append(resp.Part, Part{N: n, ETag: fakeETag(u.parts[n]), Size: int64(len(u.parts[n]))})
+	}
+	b, _ := xml.Marshal(struct {
+		XMLName xml.Name `xml:"ListPartsResult"`
+		listPartsResp
+	}{listPartsResp: resp})
+	w.Write(b)
+}
+
+func (f *fakeCOS) complete(w http.ResponseWriter, id string, body []byte) {
+	var c completeUpload
+	if err := xml.Unmarshal(body, &c); err != nil {
+		fakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var object bytes.Buffer
+	for i, p := range c.Parts {
+		data, ok := u.parts[p.PartNumber]
+		if p.PartNumber != i+1 || !ok || p.ETag != fakeETag(data) {
+			fakeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		object.Write(data)
+	}
+	f.objects[u.key] = object.Bytes()
+	// the ETag of a multipart object is not a digest of its content
+	f.header[u.key] = http.Header{"Etag": {fmt.Sprintf(`"%x-%d"`, len(c.Parts), len(c.Parts))}}
+	delete(f.uploads, id)
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", u.key)
+}
+
+func (f *fakeCOS) abort(w http.ResponseWriter, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.uploads[id]; !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	delete(f.uploads, id)
+	f.aborted = append(f.aborted, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeCOS) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	f.mu.Lock()
+	data, ok := f.objects[key]
+	header := f.header[key]
+	cut := f.cut
+	f.mu.Unlock()
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	w.Header().Set("ETag", fakeETag(data))
+	crc := crc64.Checksum(data, crc64.MakeTable(crc64.ECMA))
+	w.Header().Set("x-cos-hash-crc64ecma", strconv.FormatUint(crc, 10))
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	if cut != nil && r.Method == "GET" {
+		if n := cut(r); n >= 0 {
+			w = &cutWriter{ResponseWriter: w, left: n}
+		}
+	}
+	http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(data))
+}
+
+// cutWriter closes the connection once left bytes of the body are sent.
+type cutWriter struct {
+	http.ResponseWriter
+	left int
+	cut  bool
+}
+
+func (w *cutWriter) Write(b []byte) (int, error) {
+	if w.cut {
+		return 0, errors.New("connection cut")
+	}
+	if len(b) <= w.left {
+		w.left -= len(b)
+		return w.ResponseWriter.Write(b)
+	}
+	n, _ := w.ResponseWriter.Write(b[:w.left])
+	w.cut = true
+	w.ResponseWriter.(http.Flusher).Flush()
+	conn, _, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		conn.Close()
+	}
+	return n, errors.New("connection cut")
+}
+
+// fakeData returns size pseudo-random bytes, the same for a given size.
+func fakeData(size int) []byte {
+	b := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(b)
+	return b
+}
+
+// object returns the content stored at key, nil if there is none.
+func (f *fakeCOS) object(key string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+// counts returns the number of times each part has been sent, of uploads
+// aborted and of uploads left.
+func (f *fakeCOS) counts() (sent map[int]int, aborted, left int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sent = make(map[int]int)
+	for n, times := range f.sent {
+		sent[n] = times
+	}
+	return sent, len(f.aborted), len(f.uploads)
+}
+
+// setFailPart replaces failPart.
+func (f *fakeCOS) setFailPart(fail func(n int) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failPart = fail
+}
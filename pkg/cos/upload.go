@@ -0,0 +1,163 @@
+package cos
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+const (
+	// MinPartSize is the minimum size of the parts of a multipart upload, but the last one.
+	MinPartSize = 1 << 20
+	// MaxParts is the maximum number of parts of a multipart upload.
+	MaxParts = 10000
+
+	DefaultPartSize          = 8 << 20
+	DefaultUploadThreshold   = 16 << 20
+	DefaultUploadConcurrency = 4
+)
+
+// UploadOptions configure Upload.
+type UploadOptions struct {
+	Options
+	ContentType string
+	ACL         ACL
+	// Threshold is the size from which objects are uploaded in parts,
+	// DefaultUploadThreshold if zero.
+	Threshold int64
+	// PartSize is the size of the parts, DefaultPartSize if zero. It is
+	// raised to MinPartSize, or to the size needed to stay within MaxParts.
+	PartSize int64
+	// Concurrency is the number of parts uploaded at once,
+	// DefaultUploadConcurrency if zero.
+	Concurrency int
+	// StateFile, if set, makes multipart uploads resumable: their progress is
+	// saved in this file, and an upload interrupted or failed is not aborted
+	// but resumed by the next Upload of the same key with the same StateFile.
+	StateFile string
+}
+
+func (o *UploadOptions) setDefaults(size int64) {
+	if o.ContentType == "" {
+		o.ContentType = DefaultContentType
+	}
+	if o.ACL == "" {
+		o.ACL = Private
+	}
+	if o.Threshold <= 0 {
+		o.Threshold = DefaultUploadThreshold
+	}
+	if o.PartSize <= 0 {
+		o.PartSize = DefaultPartSize
+	}
+	if o.PartSize < MinPartSize {
+		o.PartSize = MinPartSize
+	}
+	if min := (size + MaxParts - 1) / MaxParts; o.PartSize < min {
+		o.PartSize = min
+	}
+	if o.Concurrency <= 0 {
+		o.Concurrency = DefaultUploadConcurrency
+	}
+}
+
+// Upload stores the size bytes of r at key. Objects smaller than the
+// threshold of opts are sent in a single request, bigger ones in parts sent
+// concurrently; the multipart upload is aborted if a part fails.
+func (b *Bucket) Upload(key string, r io.ReaderAt, size int64, opts UploadOptions) error {
+	return b.UploadWithContext(context.Background(), key, r, size, opts)
+}
+
+// UploadWithContext is like Upload, the requests are cancelled when ctx is done.
+func (b *Bucket) UploadWithContext(ctx context.Context, key string, r io.ReaderAt, size int64, opts UploadOptions) error {
+	opts.setDefaults(size)
+	if size < opts.Threshold {
+		return b.PutReaderWithContext(ctx, key, io.NewSectionReader(r, 0, size), size, opts.ContentType, opts.ACL, opts.Options)
+	}
+
+	if opts.StateFile != "" {
+		return b.uploadResumable(ctx, key, r, size, opts)
+	}
+	m, err := b.InitMultiWithContext(ctx, key, opts.ContentType, opts.ACL, opts.Options)
+	if err != nil {
+		return err
+	}
+	parts, err := m.putParts(ctx, r, size, opts.PartSize, opts.Concurrency, nil, nil)
+	if err == nil {
+		err = m.CompleteWithContext(ctx, parts)
+	}
+	if err != nil {
+		// not cancelled, so that the parts are not left behind
+		m.AbortWithContext(context.Background())
+		return err
+	}
+	return nil
+}
+
+// putParts sends the parts of the size bytes of r, concurrency at once, and
+// returns all the parts of the upload. The parts in done are not sent again.
+// If not nil, sent is called with each part sent and the hex SHA-1 of its
+// content; it may be called concurrently.
+func (m *Multi) putParts(ctx context.Context, r io.ReaderAt, size, partSize int64, concurrency int, done map[int]Part, sent func(Part, string)) ([]Part, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	count := int((size + partSize - 1) / partSize)
+	if count == 0 {
+		// an empty object is a single empty part
+		count = 1
+	}
+	parts := make([]Part, count)
+	numbers := make(chan int)
+	errs := make(chan error, concurrency)
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range numbers {
+				off := int64(n-1) * partSize
+				length := partSize
+				if off+length > size {
+					length = size - off
+				}
+				section := io.NewSectionReader(r, off, length)
+				_, _, hexsha1, err := seekerInfo(section)
+				if err == nil {
+					parts[n-1], err = m.putPart(ctx, n, section, length, hexsha1, 0)
+				}
+				if err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+				if sent != nil {
+					sent(parts[n-1], hexsha1)
+				}
+			}
+		}()
+	}
+
+send:
+	for n := 1; n <= count; n++ {
+		if p, ok := done[n]; ok {
+			parts[n-1] = p
+			continue
+		}
+		select {
+		case numbers <- n:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(numbers)
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
@@ -0,0 +1,155 @@
+package cos
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadParts(t *testing.T) {
+	f := newFakeCOS()
+	bkt, stop := f.start()
+	defer stop()
+
+	data := fakeData(5*MinPartSize + 1000)
+	err := bkt.Upload("/chart.tgz", bytes.NewReader(data), int64(len(data)), UploadOptions{
+		Threshold:   1,
+		PartSize:    MinPartSize,
+		Concurrency: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake fails Complete unless the parts are listed in order with
+	// the ETags returned for them
+	if !bytes.Equal(f.object("/chart.tgz"), data) {
+		t.Error("uploaded object differs")
+	}
+	sent, _, left := f.counts()
+	for n := 1; n <= 6; n++ {
+		if sent[n] != 1 {
+			t.Errorf("part %d sent %d times", n, sent[n])
+		}
+	}
+	if left != 0 {
+		t.Errorf("%d uploads left", left)
+	}
+}
+
+func TestUploadAbortsOnFailure(t *testing.T) {
+	f := newFakeCOS()
+	f.failPart = func(n int) bool { return n == 3 }
+	bkt, stop := f.start()
+	defer stop()
+
+	data := fakeData(5 * MinPartSize)
+	err := bkt.Upload("/chart.tgz", bytes.NewReader(data), int64(len(data)), UploadOptions{
+		Threshold:   1,
+		PartSize:    MinPartSize,
+		Concurrency: 2,
+	})
+	if e, ok := err.(*Error); !ok || e.Code != "InvalidPart" {
+		t.Fatalf("expected the error of part 3, got %v", err)
+	}
+	if _, aborted, left := f.counts(); aborted != 1 || left != 0 {
+		t.Errorf("upload not aborted: %d aborted, %d left", aborted, left)
+	}
+	if f.object("/chart.tgz") != nil {
+		t.Error("object stored")
+	}
+}
+
+func TestUploadResume(t *testing.T) {
+	f := newFakeCOS()
+	f.failPart = func(n int) bool { return n >= 4 }
+	bkt, stop := f.start()
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "helm-cos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := UploadOptions{
+		Threshold:   1,
+		PartSize:    MinPartSize,
+		Concurrency: 1,
+		StateFile:   filepath.Join(dir, "state.json"),
+	}
+
+	data := fakeData(6 * MinPartSize)
+	err = bkt.Upload("/chart.tgz", bytes.NewReader(data), int64(len(data)), opts)
+	if err == nil {
+		t.Fatal("expected the upload of part 4 to fail")
+	}
+	if _, aborted, left := f.counts(); aborted != 0 || left != 1 {
+		t.Fatalf("upload not kept: %d aborted, %d left", aborted, left)
+	}
+	if _, err := os.Stat(opts.StateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// the parts sent are listed over several pages
+	defer func(max int) { listPartsMax = max }(listPartsMax)
+	listPartsMax = 2
+	f.setFailPart(nil)
+	err = bkt.Upload("/chart.tgz", bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.object("/chart.tgz"), data) {
+		t.Error("uploaded object differs")
+	}
+	sent, _, _ := f.counts()
+	for n := 1; n <= 6; n++ {
+		if sent[n] != 1 {
+			t.Errorf("part %d sent %d times", n, sent[n])
+		}
+	}
+	if _, err := os.Stat(opts.StateFile); !os.IsNotExist(err) {
+		t.Errorf("state file left: %v", err)
+	}
+}
+
+func TestUploadResumeChangedContent(t *testing.T) {
+	f := newFakeCOS()
+	f.failPart = func(n int) bool { return n >= 3 }
+	bkt, stop := f.start()
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "helm-cos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := UploadOptions{
+		Threshold:   1,
+		PartSize:    MinPartSize,
+		Concurrency: 1,
+		StateFile:   filepath.Join(dir, "state.json"),
+	}
+
+	data := fakeData(4 * MinPartSize)
+	if err := bkt.Upload("/chart.tgz", bytes.NewReader(data), int64(len(data)), opts); err == nil {
+		t.Fatal("expected the upload of part 3 to fail")
+	}
+
+	// part 2 changed since it was sent, it must be sent again
+	data[MinPartSize+10]++
+	f.setFailPart(nil)
+	err = bkt.Upload("/chart.tgz", bytes.NewReader(data), int64(len(data)), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.object("/chart.tgz"), data) {
+		t.Error("uploaded object differs")
+	}
+	sent, _, _ := f.counts()
+	for n, times := range map[int]int{1: 1, 2: 2, 3: 1, 4: 1} {
+		if sent[n] != times {
+			t.Errorf("part %d sent %d times, expected %d", n, sent[n], times)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package repo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/imroc/helm-cos/pkg/cos/util"
+	"k8s.io/client-go/util/homedir"
+)
+
+// indexCache is a copy of an index file with the validators of its version,
+// so that it is downloaded again only once it has changed.
+type indexCache struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified,omitempty"`
+	Data         []byte `json:"data"`
+}
+
+// cacheDir returns the directory of the files cached by the plugin.
+func cacheDir() string {
+	dir := os.Getenv("XDG_CACHE_HOME")
+	if dir == "" {
+		dir = filepath.Join(homedir.HomeDir(), ".cache")
+	}
+	return filepath.Join(dir, "helm-cos")
+}
+
+// cacheFile returns the file caching the object at key of the bucket at host
+// in the given subdirectory.
+func cacheFile(subdir, host, key, ext string) string {
+	sum := sha256.Sum256([]byte(host + key))
+	return filepath.Join(cacheDir(), subdir, hex.EncodeToString(sum[:16])+ext)
+}
+
+// indexCacheFile returns the file caching the index file at key of the bucket at host.
+func indexCacheFile(host, key string) string {
+	return cacheFile("index", host, key, ".json")
+}
+
+// loadIndexCache reads the index cached in filename, nil if there is none or
+// it can't be read.
+func loadIndexCache(filename string) *indexCache {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+	c := &indexCache{}
+	if err := json.Unmarshal(b, c); err != nil || c.ETag == "" && c.LastModified == "" {
+		return nil
+	}
+	return c
+}
+
+// save writes c to filename, replacing it atomically so that concurrent
+// processes never read a partial entry. As the cached copy is always
+// revalidated, the entry of the last process wins whatever its version.
+func (c *indexCache) save(filename string) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filename, b, 0600)
+}
+
+// removeIndexCache removes the index cached in filename, if any.
+func removeIndexCache(filename string) error {
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
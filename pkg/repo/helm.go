@@ -0,0 +1,103 @@
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/util/homedir"
+	"k8s.io/helm/pkg/helm/environment"
+	"k8s.io/helm/pkg/helm/helmpath"
+	"k8s.io/helm/pkg/repo"
+)
+
+// helmVersion returns the major version of the Helm client which invoked the plugin.
+//
+// Helm 3 passes HELM_REPOSITORY_CONFIG and HELM_REPOSITORY_CACHE to plugins while
+// Helm 2 passes HELM_HOME. When none of them is set, the plugin is run outside of
+// Helm and the version is guessed from the files present at the default locations.
+func helmVersion() int {
+	if os.Getenv("HELM_REPOSITORY_CONFIG") != "" || os.Getenv("HELM_REPOSITORY_CACHE") != "" {
+		return 3
+	}
+	if os.Getenv("HELM_HOME") != "" {
+		return 2
+	}
+	if _, err := os.Stat(helm2Home().RepositoryFile()); err == nil {
+		return 2
+	}
+	if _, err := os.Stat(helm3RepositoryConfig()); err == nil {
+		return 3
+	}
+	return 2
+}
+
+func helm2Home() helmpath.Home {
+	helmHome := os.Getenv("HELM_HOME")
+	if helmHome == "" {
+		helmHome = environment.DefaultHelmHome
+	}
+	return helmpath.Home(helmHome)
+}
+
+// helm3ConfigHome returns the Helm 3 configuration directory, following the XDG base
+// directory specification with the same platform defaults as Helm.
+func helm3ConfigHome() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "helm")
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homedir.HomeDir(), "Library", "Preferences", "helm")
+	case "windows":
+		return filepath.Join(os.Getenv("APPDATA"), "helm")
+	}
+	return filepath.Join(homedir.HomeDir(), ".config", "helm")
+}
+
+// helm3CacheHome returns the Helm 3 cache directory, following the XDG base
+// directory specification with the same platform defaults as Helm.
+func helm3CacheHome() string {
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "helm")
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return filepath.Join(homedir.HomeDir(), "Library", "Caches", "helm")
+	case "windows":
+		return filepath.Join(os.TempDir(), "helm")
+	}
+	return filepath.Join(homedir.HomeDir(), ".cache", "helm")
+}
+
+func helm3RepositoryConfig() string {
+	if f := os.Getenv("HELM_REPOSITORY_CONFIG"); f != "" {
+		return f
+	}
+	return filepath.Join(helm3ConfigHome(), "repositories.yaml")
+}
+
+func helm3RepositoryCache() string {
+	if dir := os.Getenv("HELM_REPOSITORY_CACHE"); dir != "" {
+		return dir
+	}
+	return filepath.Join(helm3CacheHome(), "repository")
+}
+
+// loadHelm3RepositoriesFile loads a Helm 3 repositories file.
+// Helm 3 writes an empty apiVersion, which repo.LoadRepositoriesFile mistakes for a legacy file.
+func loadHelm3RepositoriesFile(path string) (*repo.RepoFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f := &repo.RepoFile{}
+	err = yaml.Unmarshal(b, f)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+	return f, nil
+}
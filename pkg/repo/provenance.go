@@ -0,0 +1,65 @@
+package repo
+
+import (
+	"context"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/provenance"
+
+	"github.com/imroc/helm-cos/pkg/cos"
+)
+
+// Sign creates the provenance data of the chart archive at chartpath,
+// signed with the key named key from keyring.
+// passphrase is called if the private key is encrypted.
+func Sign(chartpath, keyring, key string, passphrase provenance.PassphraseFetcher) (string, error) {
+	signer, err := provenance.NewFromKeyring(keyring, key)
+	if err != nil {
+		return "", errors.Wrap(err, "load keyring")
+	}
+	err = signer.DecryptKey(passphrase)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt key")
+	}
+	prov, err := signer.ClearSign(chartpath)
+	if err != nil {
+		return "", errors.Wrap(err, "sign")
+	}
+	if prov == "" {
+		return "", errors.New("sign: empty provenance data")
+	}
+	return prov, nil
+}
+
+// VerifyProvenance downloads the provenance file of the chart at chartPath in bkt and
+// verifies the chart archive chartfile against it, using the public keys of keyring.
+// chartfile must have the same file name as the chart in the bucket.
+func VerifyProvenance(ctx context.Context, bkt *cos.Bucket, chartPath, chartfile, keyring string) (*provenance.Verification, error) {
+	log := logger()
+	if filepath.Base(chartfile) != path.Base(chartPath) {
+		return nil, errors.Errorf("file name of %s does not match %s", chartfile, chartPath)
+	}
+	log.Debugf("get provenance file %s.prov", chartPath)
+	b, err := bkt.GetWithContext(ctx, chartPath+".prov")
+	if err != nil {
+		return nil, errors.Wrap(err, "get provenance file")
+	}
+	provfile := chartfile + ".prov"
+	err = ioutil.WriteFile(provfile, b, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "write provenance file")
+	}
+
+	signer, err := provenance.NewFromKeyring(keyring, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "load keyring")
+	}
+	ver, err := signer.Verify(chartfile, provfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "verify")
+	}
+	return ver, nil
+}
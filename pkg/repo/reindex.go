@@ -0,0 +1,152 @@
+package repo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imroc/helm-cos/pkg/cos"
+	"github.com/pkg/errors"
+	"k8s.io/helm/pkg/chartutil"
+	"k8s.io/helm/pkg/provenance"
+	"k8s.io/helm/pkg/repo"
+)
+
+// Reindex rebuilds the index file from the chart archives stored in the repository.
+//
+// If merge is true, the entries of the current index are kept and only the charts
+// missing from it are added. If dryRun is true, the differences with the current
+// index are printed and nothing is uploaded.
+func (r *Repo) Reindex(ctx context.Context, repoName string, merge, dryRun bool) error {
+	log := logger()
+	current, err := r.indexFile(ctx)
+	if err != nil {
+		// only a missing or corrupt index is replaced, other errors may hide a valid one
+		if _, corrupt := errors.Cause(err).(*corruptIndexError); !corrupt && !cos.IsNotFound(err) {
+			return errors.Wrap(err, "load index file")
+		}
+		log.Warnf("current index file is unusable, it will be replaced: %s", err)
+		current = repo.NewIndexFile()
+	}
+
+	i, err := r.indexArchives(ctx)
+	if err != nil {
+		return errors.Wrap(err, "index archives")
+	}
+	if merge {
+		m := repo.NewIndexFile()
+		m.Merge(current)
+		m.Merge(i)
+		i = m
+	}
+	i.SortEntries()
+
+	if dryRun {
+		printIndexDiff(current, i)
+		return nil
+	}
+
+	err = r.uploadIndexFile(ctx, i)
+	if err != nil {
+		return err
+	}
+	return i.WriteFile(getIndexFilePath(repoName), 0666)
+}
+
+// indexArchives downloads every chart archive of the repository and builds
+// a new index file from them.
+func (r *Repo) indexArchives(ctx context.Context) (*repo.IndexFile, error) {
+	log := logger()
+	prefix := strings.Trim(r.basePath, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	i := repo.NewIndexFile()
+	bkt := r.cos.Bucket("")
+	marker := ""
+	for {
+		resp, err := bkt.ListWithContext(ctx, prefix, "/", marker, 0)
+		if err != nil {
+			return nil, errors.Wrap(err, "list")
+		}
+		for _, k := range resp.Contents {
+			if !strings.HasSuffix(k.Key, ".tgz") {
+				continue
+			}
+			log.Debugf("indexing %s", k.Key)
+			b, err := bkt.GetWithContext(ctx, k.Key)
+			if err != nil {
+				return nil, errors.Wrapf(err, "get %s", k.Key)
+			}
+			chart, err := chartutil.LoadArchive(bytes.NewReader(b))
+			if err != nil {
+				log.Warnf("skip %s: %s", k.Key, err)
+				continue
+			}
+			hash, err := provenance.Digest(bytes.NewReader(b))
+			if err != nil {
+				return nil, errors.Wrapf(err, "digest %s", k.Key)
+			}
+			i.Add(chart.GetMetadata(), path.Base(k.Key), r.entry.URL, hash)
+			if t, err := time.Parse(time.RFC3339, k.LastModified); err == nil {
+				cvs := i.Entries[chart.Metadata.Name]
+				cvs[len(cvs)-1].Created = t
+			}
+		}
+		if !resp.IsTruncated {
+			return i, nil
+		}
+		marker = resp.NextMarker
+	}
+}
+
+// printIndexDiff prints the chart versions added, removed or modified
+// between the index files "from" and "to", by name then by version.
+func printIndexDiff(from, to *repo.IndexFile) {
+	changes := 0
+	for _, name := range sortedNames(to) {
+		for _, cv := range sortedVersions(to.Entries[name]) {
+			old, err := from.Get(name, cv.Version)
+			if err != nil {
+				fmt.Printf("+ %s-%s\n", name, cv.Version)
+				changes++
+			} else if old.Digest != cv.Digest {
+				fmt.Printf("~ %s-%s (digest %s -> %s)\n", name, cv.Version, old.Digest, cv.Digest)
+				changes++
+			}
+		}
+	}
+	for _, name := range sortedNames(from) {
+		for _, cv := range sortedVersions(from.Entries[name]) {
+			if !to.Has(name, cv.Version) {
+				fmt.Printf("- %s-%s\n", name, cv.Version)
+				changes++
+			}
+		}
+	}
+	if changes == 0 {
+		fmt.Println("index is up-to-date")
+	}
+}
+
+// sortedNames returns the names of the charts of i in alphabetical order.
+func sortedNames(i *repo.IndexFile) []string {
+	names := make([]string, 0, len(i.Entries))
+	for name := range i.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedVersions returns a copy of cvs sorted by version in descending order.
+func sortedVersions(cvs repo.ChartVersions) repo.ChartVersions {
+	sorted := append(repo.ChartVersions{}, cvs...)
+	sort.Sort(sort.Reverse(sorted))
+	return sorted
+}
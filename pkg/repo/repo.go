@@ -1,19 +1,22 @@
 package repo
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/Masterminds/semver"
 	"github.com/ghodss/yaml"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"k8s.io/helm/pkg/chartutil"
-	"k8s.io/helm/pkg/helm/environment"
-	"k8s.io/helm/pkg/helm/helmpath"
 	"k8s.io/helm/pkg/proto/hapi/chart"
 	"k8s.io/helm/pkg/provenance"
 	"k8s.io/helm/pkg/repo"
@@ -30,33 +33,41 @@ var (
 
 	// Debug is used to activate log output
 	Debug bool
+
+	// PartSize is the size of the parts of the charts uploaded in parts,
+	// UploadConcurrency the number of parts uploaded at once.
+	// The defaults of cos.UploadOptions are used if zero.
+	PartSize          int64
+	UploadConcurrency int
 )
 
 // Repo manages Helm repositories on Google Cloud Storage.
 type Repo struct {
-	entry    *repo.Entry
-	basePath string
-	//indexFileGeneration int64
-	cos *cos.Client
+	entry         *repo.Entry
+	basePath      string
+	indexFileETag string
+	cos           *cos.Client
+	// uploadedChart is the chart uploaded by PushChart, whose index update
+	// may be retried.
+	uploadedChart string
 }
 
 func (r *Repo) getIndexFileURL() string {
 	return "gs://" + path.Join(r.cos.GetEndpoint(""), r.basePath, "index.yaml")
 }
 
-func (r *Repo) checkExsits(file string) (bool, error) {
+// checkExsits reports whether file exists in the repository.
+// It fails if this can't be known, e.g. on network or permission errors.
+func (r *Repo) checkExsits(ctx context.Context, file string) (bool, error) {
 	bkt := r.cos.Bucket("")
-	resp, err := bkt.Head(path.Join(r.basePath, file), make(http.Header))
-	if err != nil {
+	_, err := bkt.HeadWithContext(ctx, path.Join(r.basePath, file), make(http.Header))
+	if cos.IsNotFound(err) {
 		return false, nil
 	}
-	if resp.StatusCode == http.StatusOK {
-		return true, nil
-	}
-	if resp.StatusCode == http.StatusNotFound {
-		return false, nil
+	if err != nil {
+		return false, errors.Wrapf(err, "head %s", file)
 	}
-	return false, fmt.Errorf("unknown status: %s", resp.Status)
+	return true, nil
 }
 
 // New creates a new Repo object
@@ -65,7 +76,7 @@ func New(path string) (*Repo, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	client, err := conf.GetCosClient(u.Host)
+	client, err := conf.GetCosClient(conf.Location(u.Host, u.Path))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -95,7 +106,7 @@ func Load(name string) (*Repo, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	cos, err := conf.GetCosClient(u.Host)
+	cos, err := conf.GetCosClient(conf.Location(u.Host, u.Path))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -109,31 +120,33 @@ func Load(name string) (*Repo, error) {
 
 // Create creates a new repository on COS.
 // This function is idempotent.
-func Create(r *Repo) error {
+func Create(ctx context.Context, r *Repo) error {
 	log := logger()
 	log.Debugf("create a repository with index file at %s", r.getIndexFileURL())
 
-	exsits, err := r.checkExsits("index.yaml")
+	exsits, err := r.checkExsits(ctx, "index.yaml")
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 	if exsits {
 		log.Debugf("file %s already exists", r.getIndexFileURL())
 		return nil
 	}
 	i := repo.NewIndexFile()
-	return r.uploadIndexFile(i)
+	return r.uploadIndexFile(ctx, i)
 }
 
 // PushChart adds a chart into the repository.
 //
-// The index file on COS will be updated and the file at "chartpath" will be uploaded to COS.
-// If the version of the chart is already indexed, it won't be uploaded unless "force" is set to true.
+// The file at "chartpath" will be uploaded to COS, then the index file on COS will be updated.
+// If the version of the chart is already indexed, it won't be uploaded unless "force" is set to true,
+// in which case its entry in the index is replaced.
 // The push will fail if the repository is updated at the same time, use "retry" to automatically reload
-// the index of the repository.
-func (r *Repo) PushChart(chartpath, repoName string, force bool) error {
+// the index of the repository. The chart is not uploaded again when PushChart is retried.
+// If prov is not empty, it is uploaded alongside the chart as its provenance file.
+func (r *Repo) PushChart(ctx context.Context, chartpath, repoName string, force bool, prov string) error {
 	log := logger()
-	i, err := r.indexFile()
+	i, err := r.indexFile(ctx)
 	if err != nil {
 		return errors.Wrap(err, "load index file")
 	}
@@ -145,23 +158,40 @@ func (r *Repo) PushChart(chartpath, repoName string, force bool) error {
 	}
 
 	log.Debugf("chart loaded: %s-%s", chart.Metadata.Name, chart.Metadata.Version)
-	if i.Has(chart.Metadata.Name, chart.Metadata.Version) && !force {
+	indexed := i.Has(chart.Metadata.Name, chart.Metadata.Version)
+	uploaded := r.uploadedChart == chartpath
+	if indexed && !force && !uploaded {
 		fmt.Printf("chart %s-%s already indexed. Use --force to still upload the chart\n", chart.Metadata.Name, chart.Metadata.Version)
 		return nil
 	}
 
-	if !i.Has(chart.Metadata.Name, chart.Metadata.Version) {
-		err := r.updateIndexFile(i, chartpath, chart)
+	// the chart is uploaded before being indexed, so that the index never
+	// refers to a missing file
+	if !uploaded {
+		log.Debugf("upload file to COS")
+		err = r.uploadChart(ctx, chartpath)
 		if err != nil {
-			return errors.Wrap(err, "update index file")
+			return errors.Wrap(err, "write chart")
+		}
+		if prov != "" {
+			err = r.uploadProvenance(ctx, chartpath, prov)
+			if err != nil {
+				return errors.Wrap(err, "write provenance")
+			}
 		}
+		r.uploadedChart = chartpath
 	}
 
-	log.Debugf("upload file to COS")
-	err = r.uploadChart(chartpath)
-	if err != nil {
-		return errors.Wrap(err, "write chart")
+	if !indexed || force {
+		err := r.updateIndexFile(ctx, i, chartpath, chart)
+		if err == ErrIndexOutOfDate {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(err, "update index file")
+		}
 	}
+
 	// update local index file
 	indexFilename := getIndexFilePath(repoName)
 	err = i.WriteFile(indexFilename, 0666)
@@ -173,11 +203,11 @@ func (r *Repo) PushChart(chartpath, repoName string, force bool) error {
 
 // RemoveChart removes a chart from the repository
 // If version is empty, all version will be deleted.
-func (r *Repo) RemoveChart(name, repoName, version string) error {
+func (r *Repo) RemoveChart(ctx context.Context, name, repoName, version string) error {
 	log := logger()
 	log.Debugf("removing chart %s-%s", name, version)
 
-	index, err := r.indexFile()
+	index, err := r.indexFile(ctx)
 	if err != nil {
 		return errors.Wrap(err, "index")
 	}
@@ -202,36 +232,130 @@ func (r *Repo) RemoveChart(name, repoName, version string) error {
 		delete(index.Entries, name)
 	}
 
-	err = r.uploadIndexFile(index)
+	err = r.uploadIndexFile(ctx, index)
 	if err != nil {
 		return err
 	}
 
 	bkt := r.cos.Bucket("")
 	// Delete charts from COS
+	failed := 0
 	for _, rawurl := range urls {
 		u, err := url.Parse(rawurl)
 		if err != nil {
 			log.Errorf("bad url:%s", rawurl)
+			failed++
 			continue
 		}
 		log.Debugf("delete cos file %s", rawurl)
-		err = bkt.Del(u.Path)
-		if err != nil {
-			log.Errorf("failed to remove chart:%s", rawurl)
-			continue
+		for _, p := range []string{u.Path, u.Path + ".prov"} {
+			err = bkt.DelWithContext(ctx, p)
+			if err != nil && !cos.IsNotFound(err) {
+				log.Errorf("failed to remove %s: %s", p, err)
+				failed++
+			}
 		}
 	}
-	index.WriteFile(getIndexFilePath(repoName), 0666)
+	err = index.WriteFile(getIndexFilePath(repoName), 0666)
+	if err != nil {
+		return errors.Wrap(err, "write index")
+	}
+	if failed > 0 {
+		return fmt.Errorf("chart removed from the index, but %d file(s) could not be deleted", failed)
+	}
 	return nil
 }
 
+// ListCharts returns the chart versions indexed in the repository, sorted by
+// name then by version in descending order.
+// If name is not empty, only the versions of this chart are returned.
+// If constraint is not empty, only the versions matching this semver constraint are returned.
+func (r *Repo) ListCharts(ctx context.Context, name, constraint string) ([]*repo.ChartVersion, error) {
+	var c *semver.Constraints
+	if constraint != "" {
+		var err error
+		c, err = semver.NewConstraint(constraint)
+		if err != nil {
+			return nil, errors.Wrap(err, "version constraint")
+		}
+	}
+
+	i, err := r.indexFile(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "index")
+	}
+
+	names := []string{}
+	for n := range i.Entries {
+		if name == "" || name == n {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	cvs := []*repo.ChartVersion{}
+	for _, n := range names {
+		for _, cv := range i.Entries[n] {
+			if c != nil {
+				v, err := semver.NewVersion(cv.Version)
+				if err != nil || !c.Check(v) {
+					continue
+				}
+			}
+			cvs = append(cvs, cv)
+		}
+	}
+	return cvs, nil
+}
+
+// IndexedDigest returns the digest recorded for the chart archive at chartPath
+// in the index file of the same directory.
+// It returns an empty string if there is no index file or if the chart is not indexed.
+func IndexedDigest(ctx context.Context, bkt *cos.Bucket, chartPath string) (string, error) {
+	log := logger()
+	chartPath = path.Clean("/" + chartPath)
+	dir := path.Dir(chartPath)
+	b, err := bkt.GetWithContext(ctx, path.Join(dir, "index.yaml"))
+	if cos.IsNotFound(err) {
+		log.Debugf("no index file in %s", dir)
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "get index.yaml")
+	}
+	i := &repo.IndexFile{}
+	if err := yaml.Unmarshal(b, i); err != nil {
+		return "", errors.Wrap(err, "unmarshal")
+	}
+	for _, cvs := range i.Entries {
+		for _, cv := range cvs {
+			for _, rawurl := range cv.URLs {
+				u, err := url.Parse(rawurl)
+				if err != nil {
+					continue
+				}
+				p := u.Path
+				if !u.IsAbs() && !path.IsAbs(p) {
+					p = path.Join(dir, p)
+				}
+				if path.Clean("/"+p) == chartPath {
+					return cv.Digest, nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
 const DefaultContentType = "application/octet-stream"
 
 // uploadIndexFile update the index file on COS.
-func (r *Repo) uploadIndexFile(i *repo.IndexFile) error {
+// The write is conditioned on the ETag retrieved by indexFile, so
+// ErrIndexOutOfDate is returned if the index has been updated since then.
+// If the index has not been loaded, the write fails if the file already exists.
+func (r *Repo) uploadIndexFile(ctx context.Context, i *repo.IndexFile) error {
 	log := logger()
-	log.Debugf("push index file")
+	log.Debugf("push index file (etag=%s)", r.indexFileETag)
 	i.SortEntries()
 
 	b, err := yaml.Marshal(i)
@@ -240,41 +364,123 @@ func (r *Repo) uploadIndexFile(i *repo.IndexFile) error {
 	}
 
 	bkt := r.cos.Bucket("")
-	err = bkt.Put(path.Join(r.basePath, "index.yaml"), b, DefaultContentType, cos.Private, cos.Options{})
+	indexPath := path.Join(r.basePath, "index.yaml")
+	opts := cos.Options{}
+	if r.indexFileETag != "" {
+		opts.IfMatch = r.indexFileETag
+	} else {
+		opts.ForbidOverwrite = true
+	}
+	err = bkt.PutWithContext(ctx, indexPath, b, DefaultContentType, cos.Private, opts)
+	if isIndexConflict(err) {
+		return ErrIndexOutOfDate
+	}
 	if err != nil {
 		return errors.Wrap(err, "write")
 	}
+	// the new ETag is unknown, the index must be reloaded before another write
+	r.indexFileETag = ""
+	if err := removeIndexCache(r.indexCacheFile()); err != nil {
+		log.Warnf("failed to remove the cached index file: %s", err)
+	}
 	return nil
 }
 
 // indexFile retrieves the index file from COS.
-// It will also retrieve the generation number of the file, for optimistic locking.
-func (r *Repo) indexFile() (*repo.IndexFile, error) {
+// It will also retrieve the ETag of the file, for optimistic locking.
+// The file is cached locally and only downloaded again once it has changed.
+func (r *Repo) indexFile(ctx context.Context) (*repo.IndexFile, error) {
 	log := logger()
 	log.Debugf("load index file \"%s\"", r.getIndexFileURL())
 
-	// retrieve index file generation
+	cacheName := r.indexCacheFile()
+	return r.fetchIndexFile(ctx, cacheName, loadIndexCache(cacheName))
+}
+
+// fetchIndexFile retrieves the index file from COS, unless it is the same as
+// the cached one if not nil.
+func (r *Repo) fetchIndexFile(ctx context.Context, cacheName string, cached *indexCache) (*repo.IndexFile, error) {
+	log := logger()
+	r.indexFileETag = ""
+	headers := make(http.Header)
+	if cached != nil {
+		if cached.ETag != "" {
+			headers.Set("If-None-Match", cached.ETag)
+		} else {
+			headers.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
 	bkt := r.cos.Bucket("")
-	b, err := bkt.Get(path.Join(r.basePath, "index.yaml"))
+	resp, err := bkt.GetResponseWithContext(ctx, path.Join(r.basePath, "index.yaml"), headers)
+	if cos.IsNotModified(err) && cached != nil {
+		i := &repo.IndexFile{}
+		if err := yaml.Unmarshal(cached.Data, i); err != nil {
+			// the cached copy is damaged, not the index file
+			log.Debugf("cached index file is unusable, reloading it: %s", err)
+			removeIndexCache(cacheName)
+			return r.fetchIndexFile(ctx, cacheName, nil)
+		}
+		log.Debugf("index file not modified, using the cached copy (etag=%s)", cached.ETag)
+		r.indexFileETag = cached.ETag
+		i.SortEntries()
+		return i, nil
+	}
 	if err != nil {
+		if cos.IsNotFound(err) {
+			removeIndexCache(cacheName)
+		}
 		return nil, errors.Wrap(err, "get index.yaml")
 	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "read index.yaml")
+	}
+	r.indexFileETag = resp.Header.Get("ETag")
+	log.Debugf("index file etag: %s", r.indexFileETag)
 
 	i := &repo.IndexFile{}
 	if err := yaml.Unmarshal(b, i); err != nil {
-		return nil, errors.Wrap(err, "unmarshal")
+		removeIndexCache(cacheName)
+		return nil, errors.WithStack(&corruptIndexError{err})
+	}
+	cached = &indexCache{
+		ETag:         r.indexFileETag,
+		LastModified: resp.Header.Get("Last-Modified"),
+		Data:         b,
+	}
+	if cached.ETag != "" || cached.LastModified != "" {
+		// the index is usable even if it can't be cached
+		if err := cached.save(cacheName); err != nil {
+			log.Debugf("failed to cache the index file: %s", err)
+		}
 	}
 	i.SortEntries()
 	return i, nil
 }
 
+// indexCacheFile returns the local file caching the index file of the repository.
+func (r *Repo) indexCacheFile() string {
+	return indexCacheFile(r.cos.GetHost(""), path.Join(r.basePath, "index.yaml"))
+}
+
+// corruptIndexError is returned by indexFile when the index file can't be parsed.
+type corruptIndexError struct {
+	err error
+}
+
+func (e *corruptIndexError) Error() string {
+	return "unmarshal: " + e.err.Error()
+}
+
 // uploadChart pushes a chart into the repository.
-func (r *Repo) uploadChart(chartpath string) error {
+func (r *Repo) uploadChart(ctx context.Context, chartpath string) error {
 	log := logger()
 	f, err := os.Open(chartpath)
 	if err != nil {
 		return errors.Wrap(err, "open")
 	}
+	defer f.Close()
 	_, fname := filepath.Split(chartpath)
 	path := path.Join(r.basePath, fname)
 	log.Debugf("upload file %s to cos path %s", fname, path)
@@ -283,14 +489,37 @@ func (r *Repo) uploadChart(chartpath string) error {
 	if err != nil {
 		return errors.Wrap(err, "file state")
 	}
-	err = bkt.PutReader(path, f, state.Size(), DefaultContentType, cos.Private, cos.Options{})
+	err = bkt.UploadWithContext(ctx, path, f, state.Size(), cos.UploadOptions{
+		ContentType: DefaultContentType,
+		ACL:         cos.Private,
+		PartSize:    PartSize,
+		Concurrency: UploadConcurrency,
+		StateFile:   uploadStateFile(r.cos.GetHost(""), path),
+	})
 	if err != nil {
 		return errors.Wrap(err, "upload chart file")
 	}
 	return nil
 }
 
-func (r Repo) updateIndexFile(i *repo.IndexFile, chartpath string, chart *chart.Chart) error {
+// uploadStateFile returns the file recording the progress of the multipart
+// upload of a chart to key of the bucket at host, so that an interrupted push
+// can be resumed.
+func uploadStateFile(host, key string) string {
+	return cacheFile("uploads", host, key, ".json")
+}
+
+// uploadProvenance pushes the provenance file of a chart into the repository.
+func (r *Repo) uploadProvenance(ctx context.Context, chartpath, prov string) error {
+	log := logger()
+	_, fname := filepath.Split(chartpath)
+	path := path.Join(r.basePath, fname+".prov")
+	log.Debugf("upload provenance file to cos path %s", path)
+	bkt := r.cos.Bucket("")
+	return bkt.PutWithContext(ctx, path, []byte(prov), DefaultContentType, cos.Private, cos.Options{})
+}
+
+func (r *Repo) updateIndexFile(ctx context.Context, i *repo.IndexFile, chartpath string, chart *chart.Chart) error {
 	log := logger()
 	hash, err := provenance.DigestFile(chartpath)
 	if err != nil {
@@ -298,30 +527,55 @@ func (r Repo) updateIndexFile(i *repo.IndexFile, chartpath string, chart *chart.
 	}
 	_, fname := filepath.Split(chartpath)
 	log.Debugf("indexing chart '%s-%s' as '%s' (base url: %s)", chart.Metadata.Name, chart.Metadata.Version, fname, r.entry.URL)
+	// a version pushed again replaces its entry, but keeps its creation time
+	var created time.Time
+	vs := i.Entries[chart.Metadata.Name]
+	for k, cv := range vs {
+		if cv.Version == chart.Metadata.Version {
+			created = cv.Created
+			i.Entries[chart.Metadata.Name] = append(vs[:k], vs[k+1:]...)
+			break
+		}
+	}
 	i.Add(chart.GetMetadata(), fname, r.entry.URL, hash)
-	return r.uploadIndexFile(i)
+	if !created.IsZero() {
+		vs = i.Entries[chart.Metadata.Name]
+		vs[len(vs)-1].Created = created
+	}
+	return r.uploadIndexFile(ctx, i)
+}
+
+// isIndexConflict reports whether a conditional write of the index file
+// was rejected because the file changed in the meantime.
+func isIndexConflict(err error) bool {
+	return cos.IsPreconditionFailed(err) || cos.IsConflict(err)
 }
 
 func getIndexFilePath(name string) string {
 	log := logger()
-	helmHome := os.Getenv("HELM_HOME")
-	if helmHome == "" {
-		helmHome = environment.DefaultHelmHome
+	if helmVersion() == 3 {
+		cache := helm3RepositoryCache()
+		log.Debugf("helm 3 repository cache: %s", cache)
+		return filepath.Join(cache, name+"-index.yaml")
 	}
-	log.Debugf("helm home: %s", helmHome)
-	h := helmpath.Home(helmHome)
+	h := helm2Home()
+	log.Debugf("helm home: %s", h)
 	return h.CacheIndex(name)
 }
 
 func retrieveRepositoryEntry(name string) (*repo.Entry, error) {
 	log := logger()
-	helmHome := os.Getenv("HELM_HOME")
-	if helmHome == "" {
-		helmHome = environment.DefaultHelmHome
+	var repoFile *repo.RepoFile
+	var err error
+	if helmVersion() == 3 {
+		config := helm3RepositoryConfig()
+		log.Debugf("helm 3 repository config: %s", config)
+		repoFile, err = loadHelm3RepositoriesFile(config)
+	} else {
+		h := helm2Home()
+		log.Debugf("helm home: %s", h)
+		repoFile, err = repo.LoadRepositoriesFile(h.RepositoryFile())
 	}
-	log.Debugf("helm home: %s", helmHome)
-	h := helmpath.Home(helmHome)
-	repoFile, err := repo.LoadRepositoriesFile(h.RepositoryFile())
 	if err != nil {
 		return nil, errors.Wrap(err, "load")
 	}
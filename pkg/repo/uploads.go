@@ -0,0 +1,67 @@
+package repo
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imroc/helm-cos/pkg/cos"
+	"github.com/pkg/errors"
+)
+
+// Upload is an unfinished multipart upload in the repository.
+type Upload struct {
+	Key       string    `json:"key"`
+	UploadID  string    `json:"upload_id"`
+	Initiated time.Time `json:"initiated"`
+
+	multi *cos.Multi
+}
+
+// Uploads returns the unfinished multipart uploads of the repository, the
+// oldest first. Only the uploads of chart archives directly in the repository
+// are returned, the ones PushChart makes, not those of nested repositories or
+// of other applications.
+func (r *Repo) Uploads(ctx context.Context) ([]*Upload, error) {
+	log := logger()
+	prefix := strings.Trim(r.basePath, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	bkt := r.cos.Bucket("")
+	multis, _, err := bkt.ListMultiWithContext(ctx, prefix, "/")
+	if err != nil {
+		return nil, errors.Wrap(err, "list multipart uploads")
+	}
+	uploads := []*Upload{}
+	for _, m := range multis {
+		name := strings.TrimPrefix(strings.TrimPrefix(m.Key, "/"), prefix)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ".tgz") {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, m.Initiated)
+		if err != nil {
+			log.Warnf("upload %s of %s: bad initiation time %q", m.UploadID, m.Key, m.Initiated)
+		}
+		uploads = append(uploads, &Upload{
+			Key:       m.Key,
+			UploadID:  m.UploadID,
+			Initiated: t,
+			multi:     m,
+		})
+	}
+	sort.SliceStable(uploads, func(i, j int) bool {
+		return uploads[i].Initiated.Before(uploads[j].Initiated)
+	})
+	return uploads, nil
+}
+
+// AbortUpload aborts an unfinished multipart upload, deleting its parts.
+func (r *Repo) AbortUpload(ctx context.Context, u *Upload) error {
+	err := u.multi.AbortWithContext(ctx)
+	if err != nil && !cos.IsNotFound(err) {
+		return errors.Wrapf(err, "abort upload %s of %s", u.UploadID, u.Key)
+	}
+	return nil
+}
@@ -1,3 +1,5 @@
 #!/bin/sh
 
-$HELM_PLUGIN_DIR/bin/helm-cos pull $*
+# Helm 2 and Helm 3 both call downloaders as: pull.sh certFile keyFile caFile fullURL
+plugin_dir=${HELM_PLUGIN_DIR:-$(cd "$(dirname "$0")/.." && pwd)}
+exec "$plugin_dir/bin/helm-cos" pull "$@"